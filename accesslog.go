@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The accessLogEntry structure carries the information recorded for each
+// request handled by the router.
+type accessLogEntry struct {
+	time      time.Time
+	remote    string
+	method    string
+	host      string
+	uri       string
+	proto     string
+	referer   string
+	userAgent string
+	requestID string
+	service   string
+	endpoint  string
+	status    int
+	bytesIn   int64
+	bytesOut  int64
+	attempts  int
+	upstream  time.Duration
+	latency   time.Duration
+}
+
+// The accessLogFormat type is the signature of functions that serialize access
+// log entries, each call must write a single line to the buffer.
+type accessLogFormat func(*bytes.Buffer, *accessLogEntry)
+
+// accessLogFormats maps the format names accepted in the configuration to
+// their implementation.
+var accessLogFormats = map[string]accessLogFormat{
+	"json":     formatAccessLogJSON,
+	"logfmt":   formatAccessLogLogfmt,
+	"common":   formatAccessLogCommon,
+	"combined": formatAccessLogCombined,
+}
+
+// The accessLogger type writes access log entries to an output, entries may be
+// sampled to reduce the volume of logs generated on busy routers. Responses
+// with a 5xx status are always logged regardless of the sampling rate.
+type accessLogger struct {
+	format accessLogFormat
+	sample float64
+
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+	output io.Writer
+}
+
+type accessLoggerConfig struct {
+	sink       string // stderr, file, syslog
+	format     string
+	sample     float64
+	file       string
+	maxSize    int64
+	maxBackups int
+	syslog     string // network://address, empty for the local syslog daemon
+}
+
+func newAccessLogger(config accessLoggerConfig) (*accessLogger, error) {
+	format := accessLogFormats[config.format]
+
+	if format == nil {
+		return nil, fmt.Errorf("unsupported access log format: %q", config.format)
+	}
+
+	if config.sample < 0 || config.sample > 1 {
+		return nil, fmt.Errorf("access log sampling rate must be between 0 and 1: %g", config.sample)
+	}
+
+	var output io.Writer
+	var err error
+
+	switch config.sink {
+	case "stderr":
+		output = os.Stderr
+	case "file":
+		output, err = openRotatingFile(config.file, config.maxSize, config.maxBackups)
+	case "syslog":
+		output, err = dialSyslog(config.syslog)
+	default:
+		err = fmt.Errorf("unsupported access log sink: %q", config.sink)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogger{
+		format: format,
+		sample: config.sample,
+		output: output,
+	}, nil
+}
+
+func (l *accessLogger) log(e *accessLogEntry) {
+	if e.status < 500 && l.sample < 1 && rand.Float64() >= l.sample {
+		return
+	}
+
+	l.mutex.Lock()
+	l.buffer.Reset()
+	l.format(&l.buffer, e)
+	l.output.Write(l.buffer.Bytes())
+	l.mutex.Unlock()
+}
+
+func formatAccessLogJSON(b *bytes.Buffer, e *accessLogEntry) {
+	json.NewEncoder(b).Encode(struct {
+		Time      time.Time `json:"time"`
+		Remote    string    `json:"remote"`
+		Method    string    `json:"method"`
+		Host      string    `json:"host"`
+		URI       string    `json:"uri"`
+		Proto     string    `json:"proto"`
+		Referer   string    `json:"referer,omitempty"`
+		UserAgent string    `json:"user_agent,omitempty"`
+		RequestID string    `json:"request_id,omitempty"`
+		Service   string    `json:"service,omitempty"`
+		Endpoint  string    `json:"endpoint,omitempty"`
+		Status    int       `json:"status"`
+		BytesIn   int64     `json:"bytes_in"`
+		BytesOut  int64     `json:"bytes_out"`
+		Attempts  int       `json:"attempts"`
+		Upstream  float64   `json:"upstream_latency"`
+		Latency   float64   `json:"latency"`
+	}{
+		Time:      e.time,
+		Remote:    e.remote,
+		Method:    e.method,
+		Host:      e.host,
+		URI:       e.uri,
+		Proto:     e.proto,
+		Referer:   e.referer,
+		UserAgent: e.userAgent,
+		RequestID: e.requestID,
+		Service:   e.service,
+		Endpoint:  e.endpoint,
+		Status:    e.status,
+		BytesIn:   e.bytesIn,
+		BytesOut:  e.bytesOut,
+		Attempts:  e.attempts,
+		Upstream:  e.upstream.Seconds(),
+		Latency:   e.latency.Seconds(),
+	})
+}
+
+func formatAccessLogLogfmt(b *bytes.Buffer, e *accessLogEntry) {
+	writeLogfmt(b, "time", e.time.Format(time.RFC3339Nano))
+	writeLogfmt(b, "remote", e.remote)
+	writeLogfmt(b, "method", e.method)
+	writeLogfmt(b, "host", e.host)
+	writeLogfmt(b, "uri", e.uri)
+	writeLogfmt(b, "proto", e.proto)
+	writeLogfmt(b, "referer", e.referer)
+	writeLogfmt(b, "user_agent", e.userAgent)
+	writeLogfmt(b, "request_id", e.requestID)
+	writeLogfmt(b, "service", e.service)
+	writeLogfmt(b, "endpoint", e.endpoint)
+	writeLogfmt(b, "status", strconv.Itoa(e.status))
+	writeLogfmt(b, "bytes_in", strconv.FormatInt(e.bytesIn, 10))
+	writeLogfmt(b, "bytes_out", strconv.FormatInt(e.bytesOut, 10))
+	writeLogfmt(b, "attempts", strconv.Itoa(e.attempts))
+	writeLogfmt(b, "upstream_latency", e.upstream.String())
+	writeLogfmt(b, "latency", e.latency.String())
+	b.WriteByte('\n')
+}
+
+func writeLogfmt(b *bytes.Buffer, key string, value string) {
+	if len(value) == 0 {
+		return
+	}
+
+	if b.Len() != 0 {
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(key)
+	b.WriteByte('=')
+
+	if strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, isControl) >= 0 {
+		value = strconv.Quote(value)
+	}
+
+	b.WriteString(value)
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+func formatAccessLogCommon(b *bytes.Buffer, e *accessLogEntry) {
+	writeAccessLogCommon(b, e)
+	b.WriteByte('\n')
+}
+
+func formatAccessLogCombined(b *bytes.Buffer, e *accessLogEntry) {
+	writeAccessLogCommon(b, e)
+	b.WriteString(` "`)
+	b.WriteString(escapeCommonLog(e.referer))
+	b.WriteString(`" "`)
+	b.WriteString(escapeCommonLog(e.userAgent))
+	b.WriteString("\"\n")
+}
+
+func writeAccessLogCommon(b *bytes.Buffer, e *accessLogEntry) {
+	remote := e.remote
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	b.WriteString(commonLogValue(remote))
+	b.WriteString(" - - [")
+	b.WriteString(e.time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString(`] "`)
+	b.WriteString(escapeCommonLog(e.method + " " + e.uri + " " + e.proto))
+	b.WriteString(`" `)
+	b.WriteString(strconv.Itoa(e.status))
+	b.WriteByte(' ')
+
+	if e.bytesOut == 0 {
+		b.WriteByte('-')
+	} else {
+		b.WriteString(strconv.FormatInt(e.bytesOut, 10))
+	}
+}
+
+func commonLogValue(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func escapeCommonLog(s string) string {
+	q := strconv.Quote(s)
+	return q[1 : len(q)-1]
+}
+
+// The rotatingFile type is an io.Writer that writes to a file and rotates it
+// when it grows beyond a maximum size. Rotated files are renamed with a numeric
+// suffix, path.1 being the most recent, and only maxBackups of them are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if len(path) == 0 {
+		return nil, errors.New("no path configured for the access log file")
+	}
+
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) Write(b []byte) (n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize != 0 && f.size != 0 && f.size+int64(len(b)) > f.maxSize {
+		if err = f.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, err = f.file.Write(b)
+	f.size += int64(n)
+	return
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+
+	if f.maxBackups == 0 {
+		os.Remove(f.path)
+	} else {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	}
+
+	return f.open()
+}
+
+func dialSyslog(address string) (io.Writer, error) {
+	var network string
+
+	if i := strings.Index(address, "://"); i >= 0 {
+		network, address = address[:i], address[i+3:]
+	}
+
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_LOCAL0, "consul-router")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var accessLogTestEntry = accessLogEntry{
+	time:      time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+	remote:    "127.0.0.1:56789",
+	method:    "GET",
+	host:      "host-1.local",
+	uri:       "/hello?name=world",
+	proto:     "HTTP/1.1",
+	userAgent: `curl "7.51"`,
+	requestID: "1234",
+	service:   "host-1",
+	endpoint:  "10.0.0.1:1000",
+	status:    200,
+	bytesIn:   0,
+	bytesOut:  42,
+	attempts:  1,
+	upstream:  10 * time.Millisecond,
+	latency:   12 * time.Millisecond,
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+	}{
+		{
+			format: "logfmt",
+			line:   `time=2017-01-02T03:04:05Z remote=127.0.0.1:56789 method=GET host=host-1.local uri="/hello?name=world" proto=HTTP/1.1 user_agent="curl \"7.51\"" request_id=1234 service=host-1 endpoint=10.0.0.1:1000 status=200 bytes_in=0 bytes_out=42 attempts=1 upstream_latency=10ms latency=12ms` + "\n",
+		},
+		{
+			format: "common",
+			line:   `127.0.0.1 - - [02/Jan/2017:03:04:05 +0000] "GET /hello?name=world HTTP/1.1" 200 42` + "\n",
+		},
+		{
+			format: "combined",
+			line:   `127.0.0.1 - - [02/Jan/2017:03:04:05 +0000] "GET /hello?name=world HTTP/1.1" 200 42 "" "curl \"7.51\""` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			accessLogFormats[test.format](b, &accessLogTestEntry)
+
+			if s := b.String(); s != test.line {
+				t.Errorf("\n%s\n%s", s, test.line)
+			}
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		b := &bytes.Buffer{}
+		formatAccessLogJSON(b, &accessLogTestEntry)
+
+		var e map[string]interface{}
+
+		if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+			t.Error(err)
+		} else if e["service"] != "host-1" || e["status"] != 200.0 || e["upstream_latency"] != 0.01 {
+			t.Errorf("%#v", e)
+		}
+	})
+}
+
+func TestAccessLogSample(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := &accessLogger{format: formatAccessLogCommon, sample: 0, output: b}
+
+	e := accessLogTestEntry
+	l.log(&e)
+
+	if b.Len() != 0 {
+		t.Error("sampled out entry was logged:", b.String())
+	}
+
+	e.status = 502
+	l.log(&e)
+
+	if b.Len() == 0 {
+		t.Error("server errors must always be logged")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, s := range []string{"123456\n", "abcdef\n", "ABCDEF\n", "!@#$%^\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, content := range map[string]string{
+		path:        "!@#$%^\n",
+		path + ".1": "ABCDEF\n",
+		path + ".2": "abcdef\n",
+	} {
+		if b, err := ioutil.ReadFile(file); err != nil {
+			t.Error(err)
+		} else if string(b) != content {
+			t.Errorf("%s: %q != %q", file, b, content)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("too many backups were kept")
+	}
+}
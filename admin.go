@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// The adminServer type is a http handler exposing a JSON API to inspect and
+// control the state of a router at runtime.
+//
+// The following endpoints are supported:
+//
+//	GET    /services           list the cached services and their endpoints
+//	GET    /services/<name>    show the cache entry of a single service
+//	DELETE /services/<name>    flush the cache entry of a service
+//	GET    /blacklist          list the black-listed endpoints and expirations
+//	PUT    /blacklist/<addr>   drain an endpoint, ?duration= defaults to 1h
+//	DELETE /blacklist/<addr>   take an endpoint off the blacklist
+//	GET    /config             dump the effective configuration
+type adminServer struct {
+	server *httpServer
+	mux    *http.ServeMux
+}
+
+// The default amount of time that endpoints stay drained when no duration is
+// specified.
+const defaultDrainTimeout = 1 * time.Hour
+
+func newAdminServer(server *httpServer) *adminServer {
+	s := &adminServer{
+		server: server,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/services", s.serveServices)
+	s.mux.HandleFunc("/services/", s.serveServices)
+	s.mux.HandleFunc("/blacklist", s.serveBlacklist)
+	s.mux.HandleFunc("/blacklist/", s.serveBlacklist)
+	s.mux.HandleFunc("/config", s.serveConfig)
+	return s
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+type adminService struct {
+	Endpoints []adminEndpoint `json:"endpoints"`
+	Error     string          `json:"error,omitempty"`
+	Expires   time.Time       `json:"expires"`
+}
+
+type adminEndpoint struct {
+	Host string   `json:"host"`
+	Port int      `json:"port"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func makeAdminService(state cacheState) adminService {
+	srv := adminService{
+		Endpoints: make([]adminEndpoint, 0, len(state.srv)),
+		Expires:   state.exp,
+	}
+	for _, s := range state.srv {
+		srv.Endpoints = append(srv.Endpoints, adminEndpoint{
+			Host: s.host,
+			Port: s.port,
+			Tags: s.tags,
+		})
+	}
+	if state.err != nil {
+		srv.Error = state.err.Error()
+	}
+	return srv
+}
+
+func (s *adminServer) serveServices(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/services"), "/")
+
+	switch {
+	case len(name) == 0 && req.Method == "GET":
+		states := s.server.cache.snapshot()
+		services := make(map[string]adminService, len(states))
+
+		for name, state := range states {
+			services[name] = makeAdminService(state)
+		}
+
+		writeJSON(w, http.StatusOK, services)
+
+	case len(name) != 0 && req.Method == "GET":
+		state, ok := s.server.cache.snapshot()[name]
+
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no cache entry for "+name)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, makeAdminService(state))
+
+	case len(name) != 0 && req.Method == "DELETE":
+		if !s.server.cache.flush(name) {
+			writeJSONError(w, http.StatusNotFound, "no cache entry for "+name)
+			return
+		}
+
+		log.WithField("name", name).Info("flushed cache entry from the admin api")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, req.Method+" is not supported on "+req.URL.Path)
+	}
+}
+
+func (s *adminServer) serveBlacklist(w http.ResponseWriter, req *http.Request) {
+	addr := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/blacklist"), "/")
+
+	switch {
+	case len(addr) == 0 && req.Method == "GET":
+		writeJSON(w, http.StatusOK, s.server.blacklist.snapshot())
+
+	case len(addr) != 0 && req.Method == "PUT":
+		timeout := defaultDrainTimeout
+
+		if d := req.URL.Query().Get("duration"); len(d) != 0 {
+			var err error
+
+			if timeout, err = parseTimeout(d); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		exp := time.Now().Add(timeout)
+		s.server.blacklist.drain(addr, exp)
+
+		log.WithFields(log.Fields{
+			"address": addr,
+			"expires": exp,
+		}).Info("draining endpoint from the admin api")
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(addr) != 0 && req.Method == "DELETE":
+		if !s.server.blacklist.remove(addr) {
+			writeJSONError(w, http.StatusNotFound, addr+" is not black-listed")
+			return
+		}
+
+		log.WithField("address", addr).Info("un-ejected endpoint from the admin api")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, req.Method+" is not supported on "+req.URL.Path)
+	}
+}
+
+func (s *adminServer) serveConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, req.Method+" is not supported on "+req.URL.Path)
+		return
+	}
+
+	configs := s.server.config.snapshot()
+	services := make(map[string]map[string]string, len(configs))
+
+	for name, cfg := range configs {
+		services[name] = cfg.settings()
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Domain   string                       `json:"domain"`
+		Defaults map[string]string            `json:"defaults"`
+		Services map[string]map[string]string `json:"services"`
+	}{
+		Domain:   s.server.domain,
+		Defaults: s.server.config.defaults.settings(),
+		Services: services,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(val)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
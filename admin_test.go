@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	var server *httpServer
+
+	_, stop := newTestRouter(t, "host-1", nil, httpServerConfig{
+		rslv: serviceMap{
+			"host-1": []service{{"host-1", 1000, []string{"A"}}},
+		},
+		source: configMap{"host-1": {"prefer": "A"}},
+	}, withServer(&server))
+	defer stop()
+
+	server.cache.resolve("host-1")
+	server.config.lookup("host-1")
+
+	admin := httptest.NewServer(newAdminServer(server))
+	defer admin.Close()
+
+	do := func(method string, path string, status int, val interface{}) {
+		req, _ := http.NewRequest(method, admin.URL+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != status {
+			t.Errorf("%s %s: bad status: %d != %d", method, path, res.StatusCode, status)
+		}
+
+		if val != nil {
+			if err := json.NewDecoder(res.Body).Decode(val); err != nil {
+				t.Errorf("%s %s: %s", method, path, err)
+			}
+		}
+	}
+
+	t.Run("services", func(t *testing.T) {
+		var services map[string]adminService
+		do("GET", "/services", http.StatusOK, &services)
+
+		endpoints := []adminEndpoint{{Host: "host-1", Port: 1000, Tags: []string{"A"}}}
+
+		if !reflect.DeepEqual(services["host-1"].Endpoints, endpoints) {
+			t.Errorf("%#v", services)
+		}
+
+		do("GET", "/services/host-2", http.StatusNotFound, nil)
+		do("DELETE", "/services/host-1", http.StatusNoContent, nil)
+		do("GET", "/services/host-1", http.StatusNotFound, nil)
+	})
+
+	t.Run("blacklist", func(t *testing.T) {
+		var blacklist map[string]time.Time
+
+		do("PUT", "/blacklist/host-1?duration=1m", http.StatusNoContent, nil)
+		do("GET", "/blacklist", http.StatusOK, &blacklist)
+
+		if _, ok := blacklist["host-1"]; !ok {
+			t.Errorf("%#v", blacklist)
+		}
+
+		if srv, _ := server.rslv.resolve("host-1"); len(srv) != 0 {
+			t.Errorf("drained endpoint was returned by the resolver: %#v", srv)
+		}
+
+		do("PUT", "/blacklist/host-1?duration=whenever", http.StatusBadRequest, nil)
+		do("DELETE", "/blacklist/host-1", http.StatusNoContent, nil)
+		do("DELETE", "/blacklist/host-1", http.StatusNotFound, nil)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		var config struct {
+			Defaults map[string]string
+			Services map[string]map[string]string
+		}
+		do("GET", "/config", http.StatusOK, &config)
+
+		if config.Defaults["prefer"] != "" || config.Services["host-1"]["prefer"] != "A" {
+			t.Errorf("%#v", config)
+		}
+
+		do("POST", "/config", http.StatusMethodNotAllowed, nil)
+	})
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"net"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -45,9 +47,51 @@ func (b *blacklist) add(addr string) {
 		b.addr[addr] = lim
 	}
 
+	blacklistGauge.Set(float64(len(b.addr)))
 	b.mutex.Unlock()
 }
 
+// drain black-lists addr until exp, unlike add it always overwrites the
+// expiration time.
+func (b *blacklist) drain(addr string, exp time.Time) {
+	b.mutex.Lock()
+	b.addr[addr] = exp
+	blacklistGauge.Set(float64(len(b.addr)))
+	b.mutex.Unlock()
+}
+
+// remove takes addr off the blacklist, it returns false if the address wasn't
+// black-listed.
+func (b *blacklist) remove(addr string) (ok bool) {
+	now := time.Now()
+	b.mutex.Lock()
+
+	if exp, exist := b.addr[addr]; exist {
+		ok = !now.After(exp)
+		delete(b.addr, addr)
+	}
+
+	blacklistGauge.Set(float64(len(b.addr)))
+	b.mutex.Unlock()
+	return
+}
+
+// snapshot returns the black-listed addresses and their expiration times.
+func (b *blacklist) snapshot() map[string]time.Time {
+	now := time.Now()
+	addr := make(map[string]time.Time)
+	b.mutex.RLock()
+
+	for a, exp := range b.addr {
+		if !now.After(exp) {
+			addr[a] = exp
+		}
+	}
+
+	b.mutex.RUnlock()
+	return addr
+}
+
 func (b *blacklist) resolve(name string) (srv []service, err error) {
 	if srv, err = b.rslv.resolve(name); err != nil {
 		return
@@ -57,18 +101,33 @@ func (b *blacklist) resolve(name string) (srv []service, err error) {
 	now := time.Now()
 	b.mutex.RLock()
 
-	for _, s := range srv { // filter out black-listed hosts
-		if exp, bad := b.addr[s.host]; !bad || now.After(exp) {
+	// Hosts and endpoints are filtered out, retries black-list the address
+	// and port of the endpoint that failed.
+	for _, s := range srv {
+		if !b.excluded(s.host, now) && !b.excluded(net.JoinHostPort(s.host, strconv.Itoa(s.port)), now) {
 			srv[i] = s
 			i++
 		}
 	}
 
 	b.mutex.RUnlock()
+	observeFiltered(name, len(srv)-i)
+
+	// The service exists but all its endpoints are black-listed, this is
+	// reported differently from a service that couldn't be found.
+	if i == 0 && len(srv) != 0 {
+		return nil, errNoHealthyEndpoints
+	}
+
 	srv = srv[:i]
 	return
 }
 
+func (b *blacklist) excluded(addr string, now time.Time) bool {
+	exp, bad := b.addr[addr]
+	return bad && !now.After(exp)
+}
+
 func blacklistVacuum(mutex *sync.RWMutex, blacklist map[string]time.Time, done <-chan struct{}) {
 	const max = 100
 
@@ -98,5 +157,6 @@ func blacklistVacuumPass(mutex *sync.RWMutex, blacklist map[string]time.Time, no
 		}
 	}
 
+	blacklistGauge.Set(float64(len(blacklist)))
 	mutex.Unlock()
 }
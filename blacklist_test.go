@@ -10,6 +10,7 @@ var blacklistTests = []struct {
 	exc []string
 	srv []service
 	res []service
+	err error
 }{
 	{
 		exc: nil,
@@ -41,9 +42,31 @@ var blacklistTests = []struct {
 		srv: []service{{"host-1", 1000, nil}, {"host-2", 2000, nil}, {"host-3", 3000, nil}},
 		res: []service{{"host-3", 3000, nil}},
 	},
+	{
+		exc: []string{"host-2:2000", "host-3:4000"},
+		srv: []service{{"host-1", 1000, nil}, {"host-2", 2000, nil}, {"host-3", 3000, nil}},
+		res: []service{{"host-1", 1000, nil}, {"host-3", 3000, nil}},
+	},
+	{
+		exc: []string{"host-1:1000"},
+		srv: []service{{"host-1", 1000, nil}, {"host-1", 2000, nil}},
+		res: []service{{"host-1", 2000, nil}},
+	},
+	{
+		exc: []string{"host-1:1000", "host-2:2000"},
+		srv: []service{{"host-1", 1000, nil}, {"host-2", 2000, nil}},
+		res: nil,
+		err: errNoHealthyEndpoints,
+	},
 	{
 		exc: []string{"host-1", "host-2", "host-3"},
 		srv: []service{{"host-1", 1000, nil}, {"host-2", 2000, nil}, {"host-3", 3000, nil}},
+		res: nil,
+		err: errNoHealthyEndpoints,
+	},
+	{
+		exc: nil,
+		srv: []service{},
 		res: []service{},
 	},
 }
@@ -59,8 +82,8 @@ func TestBlacklist(t *testing.T) {
 
 			srv, err := blacklist.resolve("anything")
 
-			if err != nil {
-				t.Error(err)
+			if err != test.err {
+				t.Errorf("bad error: %v != %v", err, test.err)
 			}
 
 			if !reflect.DeepEqual(srv, test.res) {
@@ -1,38 +1,100 @@
 package main
 
 import (
+	"container/list"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/stats"
 )
 
 // The cache type is an implementation of a resolver decorator that caches
 // service endpoints returned by a base resolver using a LRU cache.
+//
+// The cache is a segmented LRU bounded to a maximum number of entries. New
+// entries are inserted in a probation segment and are promoted to a protected
+// segment when they are looked up again and have endpoints, entries are
+// evicted from the probation segment first. Clients sending requests for
+// random hostnames only churn the probation segment and cannot push services
+// that are actually in use out of the cache.
+//
+// Entries are refreshed in the background when they get close to expiring, or
+// when they are looked up after expiring but before their stale deadline,
+// callers get the cached list of endpoints right away instead of waiting for
+// the base resolver (stale-while-revalidate). When refreshing an entry fails,
+// the last list of endpoints that was resolved successfully keeps being served
+// for up to maxStale after it expired while the cache retries in the
+// background (stale-if-error).
+//
+// Entries without endpoints (unknown services or errors) are cached for the
+// negative timeout and are never served stale.
 type cache struct {
 	// Immutable fields of the cache.
-	timeout time.Duration
-	rslv    resolver
-	done    chan struct{}
+	timeout         time.Duration
+	negativeTimeout time.Duration
+	maxStale        time.Duration
+	retry           time.Duration
+	rslv            resolver
+	done            chan struct{}
+
+	// Mutable fields of the cache, kept in a separate object so the vacuum
+	// goroutine doesn't reference the cache.
+	lru *cacheLRU
+}
 
-	// Mutable fields of the cache, the mutex must be locked to access them
-	// concurrently.
-	mutex sync.RWMutex
-	cache map[string]*cacheEntry
+type cacheConfig struct {
+	timeout         time.Duration // how long entries are fresh
+	negativeTimeout time.Duration // how long entries without endpoints are cached, defaults to timeout
+	maxStale        time.Duration // how long entries are served past expiration
+	retry           time.Duration // delay between background refreshes of stale entries
+	size            int           // maximum number of entries, zero means no limit
 }
 
 type cacheEntry struct {
 	sync.RWMutex
-	srv []service
-	err error
-	exp time.Time
+	srv        []service
+	err        error
+	exp        time.Time
+	stale      time.Time // zero if the entry cannot be served past expiration
+	refreshing uint32    // atomic flag, set while refreshed in the background
+	positive   uint32    // atomic flag, set when the entry has endpoints
+
+	// Position of the entry in the LRU, the cache mutex must be locked to
+	// access these fields.
+	name      string
+	elem      *list.Element
+	protected bool
+}
+
+// deadline returns the time after which the entry is useless, it must be
+// called with the entry locked.
+func (e *cacheEntry) deadline() time.Time {
+	if e.stale.After(e.exp) {
+		return e.stale
+	}
+	return e.exp
 }
 
-func cached(timeout time.Duration, rslv resolver) *cache {
+func cached(config cacheConfig, rslv resolver) *cache {
+	if config.negativeTimeout == 0 {
+		config.negativeTimeout = config.timeout
+	}
+
+	if config.retry == 0 {
+		config.retry = 1 * time.Second
+	}
+
 	c := &cache{
-		timeout: timeout,
-		rslv:    rslv,
-		done:    make(chan struct{}),
-		cache:   make(map[string]*cacheEntry),
+		timeout:         config.timeout,
+		negativeTimeout: config.negativeTimeout,
+		maxStale:        config.maxStale,
+		retry:           config.retry,
+		rslv:            rslv,
+		done:            make(chan struct{}),
+		lru:             newCacheLRU(config.size),
 	}
 
 	// The use of a finalizer on the cache object gives us the ability to clear
@@ -41,36 +103,64 @@ func cached(timeout time.Duration, rslv resolver) *cache {
 
 	// It's important that this goroutine doesn't reference the cache object
 	// itself, otherwise it would never get garbage collected.
-	go cacheVacuum(&c.mutex, c.cache, c.done)
+	go cacheVacuum(c.lru, c.done)
 	return c
 }
 
 func (c *cache) resolve(name string) (srv []service, err error) {
 	now := time.Now()
+	expired := false
 
 	for {
-		if e := c.lookup(name, now); e != nil {
-			if now.After(e.exp) {
-				c.remove(name, e)
-			} else {
-				e.RLock()
-				srv = e.srv
-				err = e.err
-				e.RUnlock()
+		if e := c.lru.get(name); e != nil {
+			e.RLock()
+			srv, err = e.srv, e.err
+			exp, stale := e.exp, e.stale
+			e.RUnlock()
+
+			if !now.After(exp) {
+				// Entries are refreshed ahead of time when they enter the
+				// last fifth of their lifetime, so hot services never expire.
+				if !stale.IsZero() && now.After(exp.Add(-c.timeout/5)) {
+					c.refresh(name, e)
+				}
+				cacheHits.Incr()
 				break
 			}
+
+			if now.Before(stale) {
+				c.refresh(name, e)
+				cacheRevalidated.Incr()
+				break
+			}
+
+			c.lru.remove(name, e)
+			expired = true
 		}
 
-		e := &cacheEntry{exp: now.Add(c.timeout)}
+		e := &cacheEntry{}
 		e.Lock()
 
-		if !c.add(name, e) {
+		if !c.lru.add(name, e) {
 			continue
 		}
 
+		if expired {
+			cacheExpired.Incr()
+		} else {
+			cacheMisses.Incr()
+		}
 		srv, err = c.rslv.resolve(name)
-		e.srv = srv
-		e.err = err
+		c.set(e, srv, err, now)
+
+		// Names rejected by a rate limit may be resolvable on the next
+		// lookup, only concurrent lookups waiting on the entry share the
+		// error.
+		if err == errUnknownLimit {
+			e.exp = now
+			c.lru.remove(name, e)
+		}
+
 		e.Unlock()
 		break
 	}
@@ -82,38 +172,237 @@ func (c *cache) resolve(name string) (srv []service, err error) {
 	return
 }
 
-func (c *cache) lookup(name string, now time.Time) *cacheEntry {
-	c.mutex.RLock()
-	entry := c.cache[name]
-	c.mutex.RUnlock()
-	return entry
+// set updates the entry with the result of resolving the service, it must be
+// called with the entry locked.
+func (c *cache) set(e *cacheEntry, srv []service, err error, now time.Time) {
+	e.srv, e.err = srv, err
+
+	if err != nil || len(srv) == 0 {
+		e.exp, e.stale = now.Add(c.negativeTimeout), time.Time{}
+		atomic.StoreUint32(&e.positive, 0)
+	} else {
+		e.exp = now.Add(c.timeout)
+		e.stale = e.exp.Add(c.maxStale)
+		atomic.StoreUint32(&e.positive, 1)
+	}
+}
+
+// refresh starts resolving the service in the background unless a refresh of
+// the entry is already in progress.
+func (c *cache) refresh(name string, e *cacheEntry) {
+	if atomic.CompareAndSwapUint32(&e.refreshing, 0, 1) {
+		go c.revalidate(name, e)
+	}
 }
 
-func (c *cache) add(name string, entry *cacheEntry) (ok bool) {
-	c.mutex.Lock()
+// revalidate resolves the service and updates its entry, failures are retried
+// until it succeeds, the entry reaches its stale deadline, or the entry is
+// removed from the cache.
+func (c *cache) revalidate(name string, e *cacheEntry) {
+	defer atomic.StoreUint32(&e.refreshing, 0)
 
-	if c.cache[name] == nil {
-		ok = true
-		c.cache[name] = entry
+	for {
+		srv, err := c.rslv.resolve(name)
+		now := time.Now()
+
+		// Services known not to exist anymore are not served stale.
+		if err == nil || err == errUnknownService {
+			cacheRefreshes.Clone(serviceTags(name, "ok", -1)...).Incr()
+			e.Lock()
+			c.set(e, srv, err, now)
+			e.Unlock()
+			return
+		}
+
+		e.RLock()
+		exp, stale := e.exp, e.stale
+		e.RUnlock()
+
+		cacheRefreshes.Clone(serviceTags(name, "error", -1)...).Incr()
+
+		if now.After(exp) {
+			cacheStale.Clone(serviceTags(name, "", -1)...).Incr()
+			log.WithFields(log.Fields{
+				"name":  name,
+				"error": err,
+				"age":   now.Sub(exp),
+			}).Warn("serving stale endpoints after failing to resolve the service")
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-time.After(c.retry):
+		}
+
+		if c.lru.peek(name) != e || time.Now().After(stale) {
+			return
+		}
 	}
+}
 
-	c.mutex.Unlock()
-	return
+// flush removes the entry for name from the cache, the next call to resolve
+// will query the base resolver. The method returns false if no entry existed.
+func (c *cache) flush(name string) bool {
+	return c.lru.remove(name, nil)
+}
+
+// len returns the number of entries in the cache.
+func (c *cache) len() int {
+	c.lru.mutex.Lock()
+	n := len(c.lru.entries)
+	c.lru.mutex.Unlock()
+	return n
+}
+
+// The cacheState structure is a snapshot of a cache entry.
+type cacheState struct {
+	srv   []service
+	err   error
+	exp   time.Time
+	stale time.Time
+}
+
+// snapshot returns the state of all entries of the cache.
+func (c *cache) snapshot() map[string]cacheState {
+	c.lru.mutex.Lock()
+	entries := make(map[string]*cacheEntry, len(c.lru.entries))
+	for name, entry := range c.lru.entries {
+		entries[name] = entry
+	}
+	c.lru.mutex.Unlock()
+
+	// Entries are read after releasing the cache mutex because they may be
+	// locked while the base resolver is being queried.
+	states := make(map[string]cacheState, len(entries))
+	for name, entry := range entries {
+		entry.RLock()
+		states[name] = cacheState{
+			srv:   copyServices(entry.srv),
+			err:   entry.err,
+			exp:   entry.exp,
+			stale: entry.stale,
+		}
+		entry.RUnlock()
+	}
+
+	return states
+}
+
+// The cacheLRU type is the segmented LRU holding the entries of a cache.
+type cacheLRU struct {
+	mutex     sync.Mutex
+	size      int
+	entries   map[string]*cacheEntry
+	probation list.List
+	protected list.List
+}
+
+func newCacheLRU(size int) *cacheLRU {
+	return &cacheLRU{
+		size:    size,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// get returns the entry for name and marks it as recently used, entries with
+// endpoints are promoted to the protected segment.
+func (lru *cacheLRU) get(name string) *cacheEntry {
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+
+	e := lru.entries[name]
+
+	switch {
+	case e == nil:
+	case e.protected:
+		lru.protected.MoveToFront(e.elem)
+	case atomic.LoadUint32(&e.positive) != 0:
+		lru.probation.Remove(e.elem)
+		e.elem, e.protected = lru.protected.PushFront(e), true
+
+		// The protected segment is limited to most of the cache, the least
+		// recently used protected entry goes back on probation.
+		if lru.size != 0 && lru.protected.Len() > lru.size*4/5 {
+			d := lru.protected.Remove(lru.protected.Back()).(*cacheEntry)
+			d.elem, d.protected = lru.probation.PushFront(d), false
+		}
+	default:
+		lru.probation.MoveToFront(e.elem)
+	}
+
+	return e
+}
+
+// peek returns the entry for name without marking it as recently used.
+func (lru *cacheLRU) peek(name string) *cacheEntry {
+	lru.mutex.Lock()
+	e := lru.entries[name]
+	lru.mutex.Unlock()
+	return e
 }
 
-func (c *cache) remove(name string, entry *cacheEntry) {
-	c.mutex.Lock()
+// add inserts the entry in the probation segment, evicting the least recently
+// used entries if the cache is full. The method returns false if an entry
+// already existed for name.
+func (lru *cacheLRU) add(name string, e *cacheEntry) bool {
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
 
-	// Ensure the entry wasn't changed since the last time it was pulled out of
-	// the map.
-	if c.cache[name] == entry {
-		delete(c.cache, name)
+	if lru.entries[name] != nil {
+		return false
 	}
 
-	c.mutex.Unlock()
+	e.name = name
+	e.elem = lru.probation.PushFront(e)
+	lru.entries[name] = e
+
+	for lru.size != 0 && len(lru.entries) > lru.size {
+		victim := lru.probation.Back()
+
+		if victim == nil {
+			victim = lru.protected.Back()
+		}
+
+		v := victim.Value.(*cacheEntry)
+		lru.delete(v)
+
+		if v.protected {
+			cacheEvictions.Clone(stats.Tag{Name: "segment", Value: "protected"}).Incr()
+		} else {
+			cacheEvictions.Clone(stats.Tag{Name: "segment", Value: "probation"}).Incr()
+		}
+	}
+
+	return true
 }
 
-func cacheVacuum(mutex *sync.RWMutex, cache map[string]*cacheEntry, done <-chan struct{}) {
+// remove deletes the entry for name, if e is not nil the entry is only deleted
+// if it is still the one stored in the cache. The method returns false if no
+// entry was deleted.
+func (lru *cacheLRU) remove(name string, e *cacheEntry) (ok bool) {
+	lru.mutex.Lock()
+
+	if entry := lru.entries[name]; entry != nil && (e == nil || e == entry) {
+		lru.delete(entry)
+		ok = true
+	}
+
+	lru.mutex.Unlock()
+	return
+}
+
+// delete removes e from the cache, it must be called with the mutex locked.
+func (lru *cacheLRU) delete(e *cacheEntry) {
+	if e.protected {
+		lru.protected.Remove(e.elem)
+	} else {
+		lru.probation.Remove(e.elem)
+	}
+	delete(lru.entries, e.name)
+}
+
+func cacheVacuum(lru *cacheLRU, done <-chan struct{}) {
 	// This constant is used to limit the maximum number of cache entries
 	// visited during one vaccum pass to avoid locking the mutex for too
 	// long when the cache is large.
@@ -129,23 +418,31 @@ func cacheVacuum(mutex *sync.RWMutex, cache map[string]*cacheEntry, done <-chan
 		case <-done:
 			return
 		case now := <-ticker.C:
-			cacheVacuumPass(mutex, cache, now, max)
+			cacheVacuumPass(lru, now, max)
 		}
 	}
 }
 
-func cacheVacuumPass(mutex *sync.RWMutex, cache map[string]*cacheEntry, now time.Time, max int) {
+func cacheVacuumPass(lru *cacheLRU, now time.Time, max int) {
 	i := 0
-	mutex.Lock()
+	lru.mutex.Lock()
 
-	for name, entry := range cache {
+	for _, entry := range lru.entries {
 		if i++; i > max {
 			break
 		}
-		if now.After(entry.exp) {
-			delete(cache, name)
+
+		// Entries that are locked are being resolved, they're not expired.
+		if !entry.TryRLock() {
+			continue
 		}
+
+		if now.After(entry.deadline()) {
+			lru.delete(entry)
+		}
+
+		entry.RUnlock()
 	}
 
-	mutex.Unlock()
+	lru.mutex.Unlock()
 }
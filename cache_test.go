@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,7 +18,7 @@ func TestCache(t *testing.T) {
 		"host-3": []service{{"host-3", 3000, []string{"A", "B", "C"}}},
 	}
 
-	cache := cached(time.Second, services)
+	cache := cached(cacheConfig{timeout: time.Second}, services)
 
 	for _, name := range []string{"host-1", "host-2", "host-3"} {
 		t.Run(name, func(t *testing.T) {
@@ -48,7 +51,7 @@ func BenchmarkCache(b *testing.B) {
 			services[name] = []service{{name, 4242, nil}}
 		}
 
-		cache := cached(1*time.Minute, services)
+		cache := cached(cacheConfig{timeout: 1 * time.Minute}, services)
 
 		b.Run(strconv.Itoa(size), func(b *testing.B) {
 			for i := 0; i != b.N; i++ {
@@ -57,3 +60,248 @@ func BenchmarkCache(b *testing.B) {
 		})
 	}
 }
+
+func TestCacheStale(t *testing.T) {
+	var mutex sync.Mutex
+	var fail bool
+	var calls int
+
+	endpoints := []service{{"host-1", 1000, nil}}
+
+	rslv := resolverFunc(func(name string) ([]service, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		if fail {
+			return nil, errors.New("consul is down")
+		}
+		return copyServices(endpoints), nil
+	})
+
+	setFail := func(f bool) {
+		mutex.Lock()
+		fail = f
+		mutex.Unlock()
+	}
+
+	getCalls := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return calls
+	}
+
+	cache := cached(cacheConfig{
+		timeout:  10 * time.Millisecond,
+		maxStale: 100 * time.Millisecond,
+		retry:    5 * time.Millisecond,
+	}, rslv)
+
+	if _, err := cache.resolve("host-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	setFail(true)
+	time.Sleep(20 * time.Millisecond)
+
+	t.Run("stale", func(t *testing.T) {
+		srv, err := cache.resolve("host-1")
+		if err != nil {
+			t.Error("the stale entry wasn't served:", err)
+		} else if !reflect.DeepEqual(srv, endpoints) {
+			t.Errorf("%#v != %#v", srv, endpoints)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		n := getCalls()
+		time.Sleep(20 * time.Millisecond)
+
+		if getCalls() == n {
+			t.Error("the service wasn't refreshed in the background")
+		}
+	})
+
+	t.Run("recover", func(t *testing.T) {
+		setFail(false)
+		time.Sleep(20 * time.Millisecond)
+		setFail(true)
+
+		// The background refresh succeeded so the entry is fresh again and
+		// the failing resolver isn't queried.
+		if _, err := cache.resolve("host-1"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		time.Sleep(150 * time.Millisecond)
+
+		if _, err := cache.resolve("host-1"); err == nil {
+			t.Error("the entry was served past its stale deadline")
+		}
+	})
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	endpoints := []service{{"host-1", 1000, nil}}
+
+	rslv := resolverFunc(func(name string) ([]service, error) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			<-release // refreshes block until the test releases them
+		}
+		return copyServices(endpoints), nil
+	})
+	defer close(release)
+
+	cache := cached(cacheConfig{
+		timeout:  10 * time.Millisecond,
+		maxStale: time.Minute,
+	}, rslv)
+
+	if _, err := cache.resolve("host-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The entry expired, the cached endpoints are still returned right away
+	// and a single refresh is started in the background.
+	for i := 0; i != 10; i++ {
+		srv, err := cache.resolve("host-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(srv, endpoints) {
+			t.Fatalf("%#v != %#v", srv, endpoints)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Error("bad number of calls to the base resolver:", n)
+	}
+}
+
+func TestCacheNegativeTimeout(t *testing.T) {
+	var calls int32
+
+	rslv := resolverFunc(func(name string) ([]service, error) {
+		atomic.AddInt32(&calls, 1)
+		if name == "host-1" {
+			return []service{{"host-1", 1000, nil}}, nil
+		}
+		return nil, nil
+	})
+
+	cache := cached(cacheConfig{
+		timeout:         time.Minute,
+		negativeTimeout: 10 * time.Millisecond,
+		maxStale:        time.Minute,
+	}, rslv)
+
+	cache.resolve("host-1")
+	cache.resolve("host-2")
+	time.Sleep(20 * time.Millisecond)
+	cache.resolve("host-1")
+	cache.resolve("host-2")
+
+	// Only the unknown service expired, and it isn't refreshed in the
+	// background but resolved again.
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Error("bad number of calls to the base resolver:", n)
+	}
+}
+
+func TestCacheUnknownLimit(t *testing.T) {
+	var calls int32
+
+	rslv := resolverFunc(func(name string) ([]service, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, errUnknownLimit
+		}
+		return []service{{"host-1", 1000, nil}}, nil
+	})
+
+	cache := cached(cacheConfig{timeout: time.Minute, negativeTimeout: time.Minute}, rslv)
+
+	if _, err := cache.resolve("host-1"); err != errUnknownLimit {
+		t.Error("bad error:", err)
+	}
+
+	// The rejection isn't cached, the next lookup reaches the base resolver.
+	if srv, err := cache.resolve("host-1"); err != nil || len(srv) != 1 {
+		t.Error("the service wasn't resolved again:", srv, err)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	services := serviceMap{
+		"host-1": []service{{"host-1", 1000, nil}},
+		"host-2": []service{{"host-2", 2000, nil}},
+	}
+
+	cache := cached(cacheConfig{timeout: time.Minute, size: 5}, services)
+
+	// Looking up known services twice promotes them to the protected segment.
+	for i := 0; i != 2; i++ {
+		cache.resolve("host-1")
+		cache.resolve("host-2")
+	}
+
+	// Unknown names are not promoted and only evict each other.
+	for i := 0; i != 100; i++ {
+		name := "unknown-" + strconv.Itoa(i)
+		cache.resolve(name)
+		cache.resolve(name)
+	}
+
+	if n := cache.len(); n != 5 {
+		t.Error("the cache size isn't bounded:", n)
+	}
+
+	states := cache.snapshot()
+
+	for _, name := range []string{"host-1", "host-2", "unknown-99"} {
+		if _, ok := states[name]; !ok {
+			t.Errorf("%s was evicted from the cache", name)
+		}
+	}
+
+	if _, ok := states["unknown-0"]; ok {
+		t.Error("the least recently used entry wasn't evicted")
+	}
+}
+
+func TestCacheLRUProtected(t *testing.T) {
+	services := serviceMap{}
+
+	for i := 0; i != 10; i++ {
+		name := "host-" + strconv.Itoa(i)
+		services[name] = []service{{name, 1000, nil}}
+	}
+
+	cache := cached(cacheConfig{timeout: time.Minute, size: 5}, services)
+
+	// The protected segment holds at most 4 entries, the least recently used
+	// protected entries are demoted and evicted when the cache is full.
+	for i := 0; i != 10; i++ {
+		name := "host-" + strconv.Itoa(i)
+		cache.resolve(name)
+		cache.resolve(name)
+	}
+
+	states := cache.snapshot()
+
+	if len(states) != 5 {
+		t.Error("the cache size isn't bounded:", len(states))
+	}
+
+	for i := 5; i != 10; i++ {
+		if _, ok := states["host-"+strconv.Itoa(i)]; !ok {
+			t.Errorf("host-%d was evicted from the cache", i)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compression type compresses responses forwarded to clients that accept
+// compressed payloads, services don't have to implement it themselves.
+//
+// Responses are compressed when their content type is in the configured list,
+// they're larger than the minimum size (or have no known length), and the
+// service didn't already encode them.
+//
+// The encoding is negotiated with the q-values of the Accept-Encoding header,
+// brotli is preferred over zstd and gzip when the client weighs them equally.
+//
+// A nil *compression is valid and never compresses responses.
+type compression struct {
+	minSize  int64
+	types    []string
+	encoders []*encoder // ordered by preference
+}
+
+type compressionConfig struct {
+	level   int      // gzip compression level
+	minSize int64    // minimum size of compressed responses
+	types   []string // media types that get compressed, may be wildcards like text/*
+}
+
+// brotliLevel is the brotli compression level of responses, higher levels are
+// too slow to compress responses on the fly.
+const brotliLevel = 4
+
+// defaultCompressedTypes is the list of media types compressed by default.
+var defaultCompressedTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// The encoder type pools the writers of a content encoding the same way the
+// bufferPool type pools byte slices.
+type encoder struct {
+	name string
+	pool sync.Pool
+}
+
+// The encoderWriter interface is implemented by the writers of compression
+// algorithms that can be reset and flushed, like *gzip.Writer.
+type encoderWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+func newEncoder(name string, new func() encoderWriter) *encoder {
+	return &encoder{
+		name: name,
+		pool: sync.Pool{New: func() interface{} { return new() }},
+	}
+}
+
+func (e *encoder) get(w io.Writer) encoderWriter {
+	ew := e.pool.Get().(encoderWriter)
+	ew.Reset(w)
+	return ew
+}
+
+func (e *encoder) put(ew encoderWriter) {
+	ew.Reset(nil)
+	e.pool.Put(ew)
+}
+
+func newCompression(config compressionConfig) (*compression, error) {
+	// Validates the compression level, the writers created by the pool can't
+	// report errors.
+	if _, err := gzip.NewWriterLevel(nil, config.level); err != nil {
+		return nil, err
+	}
+
+	if len(config.types) == 0 {
+		config.types = defaultCompressedTypes
+	}
+
+	return &compression{
+		minSize: config.minSize,
+		types:   config.types,
+		encoders: []*encoder{
+			newEncoder("br", func() encoderWriter {
+				return brotli.NewWriterLevel(nil, brotliLevel)
+			}),
+			newEncoder("zstd", func() encoderWriter {
+				// Pooled writers compress one response at a time, they don't
+				// need the goroutines and buffers of concurrent encoding.
+				w, _ := zstd.NewWriter(nil,
+					zstd.WithEncoderConcurrency(1),
+					zstd.WithLowerEncoderMem(true),
+				)
+				return w
+			}),
+			newEncoder("gzip", func() encoderWriter {
+				w, _ := gzip.NewWriterLevel(nil, config.level)
+				return w
+			}),
+		},
+	}, nil
+}
+
+// compress prepares the header of the response to req for compression, it
+// returns the encoder that the body must be written with, or nil if the
+// response must be sent as is.
+func (c *compression) compress(req *http.Request, res *http.Response, hdr http.Header) *encoder {
+	if c == nil || !c.compressible(res) {
+		return nil
+	}
+
+	// The representation depends on the Accept-Encoding of the request even
+	// if this client doesn't get a compressed response, caches must know.
+	addVary(hdr, "Accept-Encoding")
+
+	if req.Method == "HEAD" {
+		return nil
+	}
+
+	e := c.negotiate(req.Header.Get("Accept-Encoding"))
+	if e == nil {
+		return nil
+	}
+
+	hdr.Del("Content-Length")
+	hdr.Set("Content-Encoding", e.name)
+
+	// Compressed and uncompressed representations aren't byte-for-byte the
+	// same, strong validators must be weakened.
+	if etag := hdr.Get("Etag"); len(etag) != 0 && !strings.HasPrefix(etag, "W/") {
+		hdr.Set("Etag", "W/"+etag)
+	}
+
+	return e
+}
+
+// compressible returns true if the response is eligible for compression.
+func (c *compression) compressible(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+
+	if res.StatusCode < 200 {
+		return false
+	}
+
+	if enc := res.Header.Get("Content-Encoding"); len(enc) != 0 && enc != "identity" {
+		return false
+	}
+
+	if len(res.Header.Get("Content-Range")) != 0 {
+		return false
+	}
+
+	if strings.Contains(strings.ToLower(res.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	if res.ContentLength >= 0 && res.ContentLength < c.minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	// Event streams are flushed event by event, compressing them would only
+	// add framing overhead to each event.
+	if mediaType == "text/event-stream" {
+		return false
+	}
+
+	for _, t := range c.types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiate returns the encoder with the highest weight in the Accept-Encoding
+// header, ties are broken by the order of preference of the encoders.
+func (c *compression) negotiate(accept string) (best *encoder) {
+	var bestQ float64
+
+	for _, e := range c.encoders {
+		if q := acceptEncoding(accept, e.name); q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+
+	return
+}
+
+// acceptEncoding returns the weight of the content encoding in the
+// Accept-Encoding header, zero if it isn't accepted.
+func acceptEncoding(accept string, name string) float64 {
+	q, wildcard := -1.0, -1.0
+
+	for _, part := range strings.Split(accept, ",") {
+		switch coding, v := parseAcceptPart(part); coding {
+		case name:
+			q = v
+		case "*":
+			wildcard = v
+		}
+	}
+
+	switch {
+	case q >= 0:
+		return q
+	case wildcard >= 0:
+		return wildcard
+	default:
+		return 0
+	}
+}
+
+// addVary adds field to the Vary header unless it was already listed.
+func addVary(hdr http.Header, field string) {
+	for _, value := range hdr["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	hdr.Add("Vary", field)
+}
+
+// compressResponseWriter wraps a http.ResponseWriter to compress the response
+// body, flushing it flushes the compressed data first.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	ew encoderWriter
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	return w.ew.Write(b)
+}
+
+func (w *compressResponseWriter) Flush() {
+	w.ew.Flush()
+	responseControl("flush", http.NewResponseController(w.ResponseWriter).Flush())
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
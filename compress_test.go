@@ -0,0 +1,237 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		q      float64
+	}{
+		{"", 0},
+		{"identity", 0},
+		{"gzip", 1},
+		{"deflate, GZIP;q=0.5", 0.5},
+		{"*", 1},
+		{"*, gzip;q=0", 0},
+		{"br;q=1, *;q=0.1", 0.1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			if q := acceptEncoding(test.accept, "gzip"); q != test.q {
+				t.Errorf("%g != %g", q, test.q)
+			}
+		})
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	c, err := newCompression(compressionConfig{level: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		accept   string
+		encoding string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "br"},
+		{"gzip, zstd", "zstd"},
+		{"br;q=0.5, zstd;q=0.8, gzip", "gzip"},
+		{"br;q=0.5, zstd;q=0.8", "zstd"},
+		{"*", "br"},
+		{"br;q=0, *;q=0.5", "zstd"},
+		{"br;q=0, zstd;q=0, gzip;q=0, *", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			var encoding string
+
+			if e := c.negotiate(test.accept); e != nil {
+				encoding = e.name
+			}
+
+			if encoding != test.encoding {
+				t.Errorf("%q != %q", encoding, test.encoding)
+			}
+		})
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	c, err := newCompression(compressionConfig{level: -1, minSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		hdr    http.Header
+		length int64
+		res    bool
+	}{
+		{"text", 200, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, 1000, true},
+		{"json", 404, http.Header{"Content-Type": {"application/json"}}, 1000, true},
+		{"chunked", 200, http.Header{"Content-Type": {"text/html"}}, -1, true},
+		{"small", 200, http.Header{"Content-Type": {"text/plain"}}, 10, false},
+		{"image", 200, http.Header{"Content-Type": {"image/png"}}, 1000, false},
+		{"encoded", 200, http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}}, 1000, false},
+		{"no-transform", 200, http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"public, no-transform"}}, 1000, false},
+		{"event-stream", 200, http.Header{"Content-Type": {"text/event-stream"}}, -1, false},
+		{"partial", 206, http.Header{"Content-Type": {"text/plain"}}, 1000, false},
+		{"not-modified", 304, http.Header{"Content-Type": {"text/plain"}}, 1000, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: test.status, Header: test.hdr, ContentLength: test.length}
+
+			if ok := c.compressible(res); ok != test.res {
+				t.Errorf("%t != %t", ok, test.res)
+			}
+		})
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	tests := []struct {
+		vary []string
+		res  []string
+	}{
+		{nil, []string{"Accept-Encoding"}},
+		{[]string{"Origin"}, []string{"Origin", "Accept-Encoding"}},
+		{[]string{"origin, accept-encoding"}, []string{"origin, accept-encoding"}},
+		{[]string{"*"}, []string{"*"}},
+	}
+
+	for _, test := range tests {
+		hdr := http.Header{"Vary": test.vary}
+		addVary(hdr, "Accept-Encoding")
+
+		if strings.Join(hdr["Vary"], "|") != strings.Join(test.res, "|") {
+			t.Errorf("%q: %q != %q", test.vary, hdr["Vary"], test.res)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	c, err := newCompression(compressionConfig{level: -1, minSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("Hello World! ", 100)
+
+	url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		b := body
+		if req.URL.Path == "/small" {
+			b = "Hello World!"
+		}
+		res.Header().Set("Content-Type", "text/plain")
+		res.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		res.Header().Set("Etag", `"1234"`)
+		res.Write([]byte(b))
+	}), httpServerConfig{compression: c})
+	defer stop()
+
+	get := func(path string, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", url+path, nil)
+		req.Host = "host-1.local"
+		req.Header.Set("Accept-Encoding", accept)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	for _, test := range []struct {
+		accept   string
+		encoding string
+	}{
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"zstd", "zstd"},
+		{"gzip, zstd, br", "br"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+	} {
+		t.Run(test.accept, func(t *testing.T) {
+			res, b := get("/", test.accept)
+
+			if enc := res.Header.Get("Content-Encoding"); enc != test.encoding {
+				t.Fatalf("bad content encoding: %q", enc)
+			}
+
+			if vary := res.Header.Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("bad vary: %q", vary)
+			}
+
+			if etag := res.Header.Get("Etag"); etag != `W/"1234"` {
+				t.Errorf("bad etag: %q", etag)
+			}
+
+			r, err := decoders[test.encoding](strings.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s, _ := ioutil.ReadAll(r); string(s) != body {
+				t.Errorf("bad body: %q", s)
+			}
+		})
+	}
+
+	t.Run("identity", func(t *testing.T) {
+		res, b := get("/", "identity")
+
+		if enc := res.Header.Get("Content-Encoding"); len(enc) != 0 {
+			t.Errorf("bad content encoding: %q", enc)
+		}
+
+		if vary := res.Header.Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("bad vary: %q", vary)
+		}
+
+		if b != body {
+			t.Errorf("bad body: %q", b)
+		}
+	})
+
+	t.Run("small", func(t *testing.T) {
+		res, b := get("/small", "gzip")
+
+		if enc := res.Header.Get("Content-Encoding"); len(enc) != 0 {
+			t.Errorf("bad content encoding: %q", enc)
+		}
+
+		if b != "Hello World!" {
+			t.Errorf("bad body: %q", b)
+		}
+	})
+}
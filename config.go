@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// The serviceConfig structure carries the settings applied by the router when
+// forwarding requests to a service. The program starts with a set of defaults
+// built from its command line configuration, which are then overridden by the
+// per-service settings loaded from a configSource.
+type serviceConfig struct {
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	maxAttempts  int
+	retryBackoff time.Duration
+	balance      string
+	prefer       string
+	maxBodySize  int64
+	scheme       string
+
+	// Upper bound of the time budget of requests, applied to requests that
+	// don't set a timeout, zero means no limit.
+	maxRequestTimeout time.Duration
+
+	// Responses forwarded as streams are flushed to the client every flush
+	// interval (after each write when zero), and abort when no data was
+	// received from the service for the idle timeout (zero means no limit).
+	stream            bool
+	flushInterval     time.Duration
+	streamIdleTimeout time.Duration
+
+	// Verification of the certificates of endpoints reached over TLS, the
+	// server name defaults to the name of the service.
+	tlsServerName string
+	tlsCA         string
+	tlsInsecure   bool
+}
+
+// The list of load balancing strategies supported by the router.
+const (
+	balanceFirst  = "first"
+	balanceRandom = "random"
+)
+
+// merge returns a copy of the configuration with the settings in set applied.
+// Invalid settings are logged and ignored so a typo in a service definition
+// doesn't prevent the router from forwarding requests to it.
+func (c serviceConfig) merge(name string, set map[string]string) serviceConfig {
+	for key, value := range set {
+		if err := c.set(key, value); err != nil {
+			log.WithFields(log.Fields{
+				"name":  name,
+				"key":   key,
+				"value": value,
+				"error": err,
+			}).Warn("ignoring invalid service setting")
+		}
+	}
+	return c
+}
+
+func (c *serviceConfig) set(key string, value string) (err error) {
+	var d time.Duration
+	var n int
+	var b bool
+
+	switch key {
+	case "dial-timeout":
+		if d, err = parseTimeout(value); err == nil {
+			c.dialTimeout = d
+		}
+	case "read-timeout":
+		if d, err = parseTimeout(value); err == nil {
+			c.readTimeout = d
+		}
+	case "write-timeout":
+		if d, err = parseTimeout(value); err == nil {
+			c.writeTimeout = d
+		}
+	case "retry-backoff":
+		if d, err = parseTimeout(value); err == nil {
+			c.retryBackoff = d
+		}
+	case "flush-interval":
+		if d, err = parseTimeout(value); err == nil {
+			c.flushInterval = d
+		}
+	case "stream-idle-timeout":
+		if d, err = parseTimeout(value); err == nil {
+			c.streamIdleTimeout = d
+		}
+	case "max-request-timeout":
+		if d, err = parseTimeout(value); err == nil {
+			c.maxRequestTimeout = d
+		}
+	case "stream":
+		if b, err = strconv.ParseBool(value); err == nil {
+			c.stream = b
+		}
+	case "tls-insecure-skip-verify":
+		if b, err = strconv.ParseBool(value); err == nil {
+			c.tlsInsecure = b
+		}
+	case "tls-server-name":
+		c.tlsServerName = value
+	case "tls-ca":
+		c.tlsCA = value
+	case "max-attempts":
+		if n, err = parseLimit(value); err == nil {
+			c.maxAttempts = n
+		}
+	case "max-body-size":
+		if n, err = parseLimit(value); err == nil {
+			c.maxBodySize = int64(n)
+		}
+	case "balance":
+		switch value {
+		case balanceFirst, balanceRandom:
+			c.balance = value
+		default:
+			err = fmt.Errorf("unsupported load balancing strategy: %q", value)
+		}
+	case "prefer":
+		c.prefer = value
+	case "scheme":
+		switch value {
+		case "http", "https":
+			c.scheme = value
+		default:
+			err = fmt.Errorf("unsupported backend scheme: %q", value)
+		}
+	default:
+		err = fmt.Errorf("unknown service setting: %q", key)
+	}
+	return
+}
+
+// settings returns the configuration as key/value pairs, using the same keys
+// as the ones accepted by set.
+func (c serviceConfig) settings() map[string]string {
+	return map[string]string{
+		"dial-timeout":  c.dialTimeout.String(),
+		"read-timeout":  c.readTimeout.String(),
+		"write-timeout": c.writeTimeout.String(),
+		"retry-backoff": c.retryBackoff.String(),
+		"max-attempts":  strconv.Itoa(c.maxAttempts),
+		"max-body-size": strconv.FormatInt(c.maxBodySize, 10),
+		"balance":       c.balance,
+		"prefer":        c.prefer,
+		"scheme":        c.scheme,
+
+		"max-request-timeout": c.maxRequestTimeout.String(),
+		"stream":              strconv.FormatBool(c.stream),
+		"flush-interval":      c.flushInterval.String(),
+		"stream-idle-timeout": c.streamIdleTimeout.String(),
+
+		"tls-server-name":          c.tlsServerName,
+		"tls-ca":                   c.tlsCA,
+		"tls-insecure-skip-verify": strconv.FormatBool(c.tlsInsecure),
+	}
+}
+
+// tls returns the settings used to verify the certificates of the endpoints of
+// the service called name.
+func (c serviceConfig) tls(name string) tlsSettings {
+	s := tlsSettings{
+		serverName: c.tlsServerName,
+		ca:         c.tlsCA,
+		insecure:   c.tlsInsecure,
+	}
+	if len(s.serverName) == 0 {
+		s.serverName = name
+	}
+	return s
+}
+
+// order sorts the service list according to the load balancing strategy and
+// preferred tag of the configuration, the first entry of the returned list is
+// the one the request should be forwarded to.
+func (c serviceConfig) order(srv []service) []service {
+	if c.balance == balanceRandom {
+		shuffleServices(srv)
+	}
+	preferServices(c.prefer, srv)
+	return srv
+}
+
+// backoff returns the amount of time to wait before making the given attempt,
+// it grows quadratically with the number of attempts: 0, 1, 4, 9, ... times
+// the retry backoff.
+func (c serviceConfig) backoff(attempt int) time.Duration {
+	return time.Duration(attempt*attempt) * c.retryBackoff
+}
+
+func parseTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration: %q", s)
+	}
+	return d, err
+}
+
+func parseLimit(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("negative limit: %q", s)
+	}
+	return n, err
+}
+
+// The configSource interface is implemented by the backends from which the
+// router loads per-service settings.
+type configSource interface {
+	// The settings method returns the key/value pairs configured for the
+	// service with the given name. Services that have no specific settings
+	// should return an empty map, errors should be kept for runtime issues
+	// that prevented the source from completing the request.
+	settings(name string) (set map[string]string, err error)
+}
+
+// The configMap type implements the configSource interface and provides a
+// simple associative mapping between service names and settings, it's mostly
+// intended to be used for tests.
+type configMap map[string]map[string]string
+
+func (m configMap) settings(name string) (map[string]string, error) {
+	set := make(map[string]string, len(m[name]))
+	for key, value := range m[name] {
+		set[key] = value
+	}
+	return set, nil
+}
+
+// The serviceConfigs type keeps track of the effective configuration of each
+// service the router forwards requests to.
+//
+// Settings are loaded synchronously the first time a service is looked up,
+// then periodically reloaded in the background so changes made to the source
+// get picked up without blocking requests. The first load waits at most for
+// the load timeout, requests use the defaults if the source is slower and the
+// settings apply as soon as they're loaded.
+type serviceConfigs struct {
+	// Immutable fields of the service configurations.
+	timeout     time.Duration
+	loadTimeout time.Duration
+	defaults    serviceConfig
+	source      configSource
+
+	// Mutable fields of the service configurations, the mutex must be locked
+	// to access them concurrently.
+	mutex   sync.RWMutex
+	configs map[string]*configEntry
+}
+
+type configEntry struct {
+	sync.Mutex
+	cfg  serviceConfig
+	exp  time.Time
+	busy bool
+}
+
+func configured(timeout time.Duration, defaults serviceConfig, source configSource) *serviceConfigs {
+	return &serviceConfigs{
+		timeout:     timeout,
+		loadTimeout: configLoadTimeout,
+		defaults:    defaults,
+		source:      source,
+		configs:     make(map[string]*configEntry),
+	}
+}
+
+func (c *serviceConfigs) lookup(name string) (cfg serviceConfig) {
+	now := time.Now()
+
+	c.mutex.RLock()
+	e := c.configs[name]
+	c.mutex.RUnlock()
+
+	if e == nil {
+		// The new entry is locked before being inserted so concurrent lookups
+		// wait for the settings to be loaded.
+		e = &configEntry{}
+		e.Lock()
+		c.mutex.Lock()
+
+		if x := c.configs[name]; x != nil {
+			c.mutex.Unlock()
+			e = x
+		} else {
+			c.configs[name] = e
+			c.mutex.Unlock()
+			cfg = c.first(name, e, now)
+			e.Unlock()
+			return
+		}
+	}
+
+	e.Lock()
+	cfg = e.cfg
+
+	if !e.busy && now.After(e.exp) {
+		e.busy = true
+		go c.reload(name, e)
+	}
+
+	e.Unlock()
+	return
+}
+
+// snapshot returns the effective configuration of all known services.
+func (c *serviceConfigs) snapshot() map[string]serviceConfig {
+	c.mutex.RLock()
+	entries := make(map[string]*configEntry, len(c.configs))
+	for name, entry := range c.configs {
+		entries[name] = entry
+	}
+	c.mutex.RUnlock()
+
+	configs := make(map[string]serviceConfig, len(entries))
+	for name, entry := range entries {
+		entry.Lock()
+		configs[name] = entry.cfg
+		entry.Unlock()
+	}
+
+	return configs
+}
+
+// configLoadTimeout is how long the first lookup of a service waits for its
+// settings to be loaded.
+const configLoadTimeout = 1 * time.Second
+
+// first loads the settings of a new entry, it must be called with the entry
+// locked. When the source doesn't answer within the load timeout the entry
+// gets the defaults and is updated in the background once loading completes.
+func (c *serviceConfigs) first(name string, e *configEntry, now time.Time) serviceConfig {
+	loaded := make(chan serviceConfig, 1)
+	go func() { loaded <- c.load(name, c.defaults) }()
+
+	timer := time.NewTimer(c.loadTimeout)
+	defer timer.Stop()
+
+	select {
+	case e.cfg = <-loaded:
+		e.exp = now.Add(c.timeout)
+
+	case <-timer.C:
+		log.WithFields(log.Fields{
+			"name":    name,
+			"timeout": c.loadTimeout,
+		}).Warn("using default service configuration while loading it takes too long")
+
+		e.cfg, e.busy = c.defaults, true
+
+		go func() {
+			cfg := <-loaded
+			e.Lock()
+			e.cfg = cfg
+			e.exp = time.Now().Add(c.timeout)
+			e.busy = false
+			e.Unlock()
+		}()
+	}
+
+	return e.cfg
+}
+
+func (c *serviceConfigs) reload(name string, e *configEntry) {
+	e.Lock()
+	prev := e.cfg
+	e.Unlock()
+
+	cfg := c.load(name, prev)
+
+	if cfg != prev {
+		log.WithField("name", name).Info("service configuration changed")
+	}
+
+	e.Lock()
+	e.cfg = cfg
+	e.exp = time.Now().Add(c.timeout)
+	e.busy = false
+	e.Unlock()
+}
+
+// load fetches the settings of a service and merges them with the defaults,
+// when the source fails the previous configuration is kept.
+func (c *serviceConfigs) load(name string, prev serviceConfig) serviceConfig {
+	set, err := c.source.settings(name)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name":  name,
+			"error": err,
+		}).Warn("failed to load service configuration")
+		return prev
+	}
+
+	return c.defaults.merge(name, set)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var defaultServiceConfig = serviceConfig{
+	dialTimeout:  10 * time.Second,
+	readTimeout:  30 * time.Second,
+	writeTimeout: 30 * time.Second,
+	maxAttempts:  10,
+	retryBackoff: 10 * time.Millisecond,
+	balance:      balanceFirst,
+	scheme:       "http",
+}
+
+func TestServiceConfigMerge(t *testing.T) {
+	tests := []struct {
+		set map[string]string
+		res serviceConfig
+	}{
+		{
+			set: nil,
+			res: defaultServiceConfig,
+		},
+		{
+			set: map[string]string{
+				"dial-timeout":  "1s",
+				"read-timeout":  "2s",
+				"write-timeout": "3s",
+				"retry-backoff": "4ms",
+				"max-attempts":  "5",
+				"max-body-size": "6",
+				"balance":       "random",
+				"prefer":        "A",
+				"scheme":        "https",
+
+				"max-request-timeout": "9s",
+				"stream":              "true",
+				"flush-interval":      "7ms",
+				"stream-idle-timeout": "8s",
+			},
+			res: serviceConfig{
+				dialTimeout:  1 * time.Second,
+				readTimeout:  2 * time.Second,
+				writeTimeout: 3 * time.Second,
+				retryBackoff: 4 * time.Millisecond,
+				maxAttempts:  5,
+				maxBodySize:  6,
+				balance:      balanceRandom,
+				prefer:       "A",
+				scheme:       "https",
+
+				maxRequestTimeout: 9 * time.Second,
+				stream:            true,
+				flushInterval:     7 * time.Millisecond,
+				streamIdleTimeout: 8 * time.Second,
+			},
+		},
+		{
+			set: map[string]string{
+				"read-timeout": "whenever",
+				"max-attempts": "-1",
+				"balance":      "round-robin",
+				"scheme":       "ftp",
+				"stream":       "maybe",
+				"unknown":      "?",
+			},
+			res: defaultServiceConfig,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			if res := defaultServiceConfig.merge("anything", test.set); res != test.res {
+				t.Errorf("\n%#v\n%#v", res, test.res)
+			}
+		})
+	}
+}
+
+func TestServiceConfigOrder(t *testing.T) {
+	cfg := defaultServiceConfig
+	cfg.prefer = "A"
+
+	srv := cfg.order([]service{{"host-1", 1000, nil}, {"host-2", 2000, []string{"A"}}, {"host-3", 3000, nil}})
+	res := []service{{"host-2", 2000, []string{"A"}}, {"host-1", 1000, nil}, {"host-3", 3000, nil}}
+
+	if !reflect.DeepEqual(srv, res) {
+		t.Errorf("\n%#v\n%#v", srv, res)
+	}
+}
+
+func TestServiceConfigs(t *testing.T) {
+	source := configMap{
+		"host-1": {"read-timeout": "1s"},
+		"host-2": {"balance": "random"},
+	}
+
+	configs := configured(time.Minute, defaultServiceConfig, source)
+
+	t.Run("host-1", func(t *testing.T) {
+		if cfg := configs.lookup("host-1"); cfg.readTimeout != time.Second {
+			t.Error("bad read timeout:", cfg.readTimeout)
+		}
+	})
+
+	t.Run("host-2", func(t *testing.T) {
+		if cfg := configs.lookup("host-2"); cfg.balance != balanceRandom {
+			t.Error("bad load balancing strategy:", cfg.balance)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if cfg := configs.lookup("host-3"); cfg != defaultServiceConfig {
+			t.Errorf("\n%#v\n%#v", cfg, defaultServiceConfig)
+		}
+	})
+}
+
+// slowSource is a configSource that waits for its channel to be closed before
+// returning the settings of its configMap.
+type slowSource struct {
+	configMap
+	wait chan struct{}
+}
+
+func (s slowSource) settings(name string) (map[string]string, error) {
+	<-s.wait
+	return s.configMap.settings(name)
+}
+
+func TestServiceConfigsLoadTimeout(t *testing.T) {
+	source := slowSource{
+		configMap: configMap{"host-1": {"read-timeout": "1s"}},
+		wait:      make(chan struct{}),
+	}
+
+	configs := configured(time.Minute, defaultServiceConfig, source)
+	configs.loadTimeout = 10 * time.Millisecond
+
+	if cfg := configs.lookup("host-1"); cfg != defaultServiceConfig {
+		t.Errorf("the defaults weren't used while loading:\n%#v", cfg)
+	}
+
+	close(source.wait)
+	time.Sleep(20 * time.Millisecond)
+
+	if cfg := configs.lookup("host-1"); cfg.readTimeout != time.Second {
+		t.Error("the settings weren't applied after loading:", cfg.readTimeout)
+	}
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 )
 
+// consulClient is the http client used to query the consul agent. Lookups of
+// services happen while cache entries are locked, the timeout prevents a hung
+// agent from blocking every request to a service.
+var consulClient = &http.Client{Timeout: 5 * time.Second}
+
 // The consulResolver is a resolver implementation that uses a consul agent to
 // lookup registered services.
 type consulResolver struct {
@@ -16,17 +26,13 @@ type consulResolver struct {
 }
 
 func (r consulResolver) resolve(name string) (srv []service, err error) {
-	var res *http.Response
-	var url = r.address + "/v1/catalog/service/" + name
+	start := time.Now()
+	defer func() { observeResolve(start, name, srv, err) }()
 
-	switch {
-	case strings.HasPrefix(url, "http://"):
-	case strings.HasPrefix(url, "https://"):
-	default:
-		url = "http://" + url
-	}
+	var res *http.Response
+	var url = consulURL(r.address, "/v1/catalog/service/"+name)
 
-	if res, err = http.Get(url); err != nil {
+	if res, err = consulClient.Get(url); err != nil {
 		return
 	}
 
@@ -65,3 +71,264 @@ func (r consulResolver) resolve(name string) (srv []service, err error) {
 	}).Info("consul service discovery")
 	return
 }
+
+// The consulCatalog is a serviceCatalog implementation that lists the services
+// registered in a consul agent.
+type consulCatalog struct {
+	address string
+}
+
+func (c consulCatalog) services() (names []string, err error) {
+	var services map[string][]string
+
+	if _, err = consulGet(consulURL(c.address, "/v1/catalog/services"), &services); err != nil {
+		return
+	}
+
+	names = make([]string, 0, len(services))
+
+	for name := range services {
+		names = append(names, name)
+	}
+
+	return
+}
+
+// The consulConfig is a configSource implementation that loads per-service
+// settings from a consul agent.
+//
+// Settings are read from two places: the ServiceMeta of the registered service
+// instances, where keys are prefixed with "consul-router-", and the KV store
+// under prefix/name/, where each key holds a single setting. Values from the
+// KV store take precedence, operators can use them to override what services
+// declare when they register.
+type consulConfig struct {
+	address string
+	prefix  string
+}
+
+func (c consulConfig) settings(name string) (set map[string]string, err error) {
+	set = make(map[string]string)
+
+	if err = c.meta(name, set); err != nil {
+		return
+	}
+
+	err = c.kv(name, set)
+	return
+}
+
+func (c consulConfig) meta(name string, set map[string]string) (err error) {
+	const prefix = "consul-router-"
+
+	var list []struct {
+		ServiceMeta map[string]string `json:"ServiceMeta"`
+	}
+
+	if _, err = consulGet(consulURL(c.address, "/v1/catalog/service/"+name), &list); err != nil {
+		return
+	}
+
+	// Instances may not all be running the same version of the service, the
+	// first instance that defines a setting wins.
+	for _, s := range list {
+		for key, value := range s.ServiceMeta {
+			if strings.HasPrefix(key, prefix) {
+				key = key[len(prefix):]
+
+				if _, exist := set[key]; !exist {
+					set[key] = value
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func (c consulConfig) kv(name string, set map[string]string) (err error) {
+	var prefix = strings.Trim(c.prefix, "/") + "/" + name + "/"
+	var found bool
+	var list []struct {
+		Key   string `json:"Key"`
+		Value []byte `json:"Value"`
+	}
+
+	if found, err = consulGet(consulURL(c.address, "/v1/kv/"+prefix+"?recurse"), &list); err != nil || !found {
+		return
+	}
+
+	for _, kv := range list {
+		if key := strings.TrimPrefix(kv.Key, prefix); len(key) != 0 && !strings.Contains(key, "/") {
+			set[key] = string(kv.Value)
+		}
+	}
+
+	return
+}
+
+// consulGet sends a GET request to url and decodes the JSON response into val,
+// found is false if the agent responded with 404.
+func consulGet(url string, val interface{}) (found bool, err error) {
+	return consulGetContext(context.Background(), url, val)
+}
+
+// consulGetContext is like consulGet but the request is canceled when ctx is.
+func consulGetContext(ctx context.Context, url string, val interface{}) (found bool, err error) {
+	var req *http.Request
+	var res *http.Response
+
+	if req, err = http.NewRequestWithContext(ctx, "GET", url, nil); err != nil {
+		return
+	}
+
+	if res, err = consulClient.Do(req); err != nil {
+		return
+	}
+
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return
+	default:
+		err = errors.New(url + ": " + res.Status)
+		return
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(val); err == nil {
+		found = true
+	}
+	return
+}
+
+func consulURL(address string, path string) string {
+	url := address + path
+
+	switch {
+	case strings.HasPrefix(url, "http://"):
+	case strings.HasPrefix(url, "https://"):
+	default:
+		url = "http://" + url
+	}
+
+	return url
+}
+
+// The consulRegistration type describes how the router registers itself in the
+// consul agent so the fleet of routers can be discovered like any other
+// service, see https://www.consul.io/api/agent/service.html
+type consulRegistration struct {
+	address  string // address of the consul agent
+	id       string
+	name     string
+	host     string // advertised address, the agent's address when empty
+	port     int
+	tags     []string
+	check    string // url of the health check
+	interval time.Duration
+}
+
+func (r consulRegistration) register() error {
+	type check struct {
+		HTTP                           string `json:"HTTP"`
+		Interval                       string `json:"Interval"`
+		Timeout                        string `json:"Timeout,omitempty"`
+		DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+	}
+
+	reg := struct {
+		ID      string   `json:"ID"`
+		Name    string   `json:"Name"`
+		Address string   `json:"Address,omitempty"`
+		Port    int      `json:"Port"`
+		Tags    []string `json:"Tags,omitempty"`
+		Check   *check   `json:"Check,omitempty"`
+	}{
+		ID:      r.id,
+		Name:    r.name,
+		Address: r.host,
+		Port:    r.port,
+		Tags:    r.tags,
+	}
+
+	if len(r.check) != 0 {
+		// Instances that stay critical for long are most likely gone without
+		// deregistering, the agent cleans them up.
+		reg.Check = &check{
+			HTTP:                           r.check,
+			Interval:                       r.interval.String(),
+			Timeout:                        r.interval.String(),
+			DeregisterCriticalServiceAfter: (10 * r.interval).String(),
+		}
+	}
+
+	return consulPut(consulURL(r.address, "/v1/agent/service/register"), reg)
+}
+
+// keepRegistering registers the router in consul, retrying failed attempts
+// with a backoff that doubles from min up to max. It returns nil once the
+// router was registered, or the last error if stop was closed first.
+func (r consulRegistration) keepRegistering(stop <-chan struct{}, min time.Duration, max time.Duration) error {
+	for backoff := min; ; {
+		err := r.register()
+		if err == nil {
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"id":    r.id,
+			"retry": backoff,
+			"error": err,
+		}).Warn("failed to register the router in consul")
+
+		select {
+		case <-stop:
+			return err
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+func (r consulRegistration) deregister() error {
+	return consulPut(consulURL(r.address, "/v1/agent/service/deregister/"+r.id), nil)
+}
+
+// consulPut sends a PUT request to url with val encoded as JSON in the body,
+// the body is left empty if val is nil.
+func consulPut(url string, val interface{}) (err error) {
+	var body io.Reader
+	var req *http.Request
+	var res *http.Response
+
+	if val != nil {
+		var b []byte
+
+		if b, err = json.Marshal(val); err != nil {
+			return
+		}
+
+		body = bytes.NewReader(b)
+	}
+
+	if req, err = http.NewRequest("PUT", url, body); err != nil {
+		return
+	}
+
+	if res, err = consulClient.Do(req); err != nil {
+		return
+	}
+
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err = errors.New(url + ": " + res.Status)
+	}
+	return
+}
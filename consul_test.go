@@ -6,8 +6,11 @@ import (
 	"net/http/httptest"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestConsul(t *testing.T) {
@@ -63,5 +66,187 @@ func TestConsul(t *testing.T) {
 			t.Errorf("%#v", srv)
 		}
 	})
+}
+
+func TestConsulConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/catalog/service/host-1":
+			json.NewEncoder(res).Encode([]map[string]interface{}{
+				{"ServiceMeta": map[string]string{"consul-router-read-timeout": "1s", "consul-router-prefer": "A", "version": "1"}},
+				{"ServiceMeta": map[string]string{"consul-router-read-timeout": "2s"}},
+			})
+
+		case "/v1/kv/consul-router/services/host-1/":
+			if _, ok := req.URL.Query()["recurse"]; !ok {
+				t.Error("missing recurse query parameter")
+			}
+			json.NewEncoder(res).Encode([]map[string]interface{}{
+				{"Key": "consul-router/services/host-1/", "Value": nil},
+				{"Key": "consul-router/services/host-1/prefer", "Value": []byte("B")},
+				{"Key": "consul-router/services/host-1/max-attempts", "Value": []byte("3")},
+				{"Key": "consul-router/services/host-1/nested/key", "Value": []byte("?")},
+			})
+
+		case "/v1/catalog/service/host-2":
+			json.NewEncoder(res).Encode([]map[string]interface{}{})
+
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	source := consulConfig{
+		address: server.URL,
+		prefix:  "consul-router/services",
+	}
+
+	tests := []struct {
+		name string
+		set  map[string]string
+	}{
+		{
+			name: "host-1",
+			set:  map[string]string{"read-timeout": "1s", "prefer": "B", "max-attempts": "3"},
+		},
+		{
+			name: "host-2",
+			set:  map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			set, err := source.settings(test.name)
+			if err != nil {
+				t.Error(err)
+			} else if !reflect.DeepEqual(set, test.set) {
+				t.Errorf("%#v != %#v", set, test.set)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		if set, err := source.settings("host-3"); err != nil {
+			t.Error(err)
+		} else if len(set) != 0 {
+			t.Errorf("%#v", set)
+		}
+	})
+}
+
+func TestConsulRegistration(t *testing.T) {
+	var requests []string
+	var body map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+
+		if req.URL.Path == "/v1/agent/service/register" {
+			json.NewDecoder(req.Body).Decode(&body)
+		}
+	}))
+	defer server.Close()
+
+	reg := consulRegistration{
+		address:  server.URL,
+		id:       "consul-router-host-4000",
+		name:     "consul-router",
+		port:     4000,
+		tags:     []string{"A", "B"},
+		check:    "http://127.0.0.1:4001/",
+		interval: 10 * time.Second,
+	}
+
+	if err := reg.register(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.deregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(requests, []string{
+		"PUT /v1/agent/service/register",
+		"PUT /v1/agent/service/deregister/consul-router-host-4000",
+	}) {
+		t.Error("bad requests:", requests)
+	}
+
+	if !reflect.DeepEqual(body, map[string]interface{}{
+		"ID":   "consul-router-host-4000",
+		"Name": "consul-router",
+		"Port": 4000.0,
+		"Tags": []interface{}{"A", "B"},
+		"Check": map[string]interface{}{
+			"HTTP":                           "http://127.0.0.1:4001/",
+			"Interval":                       "10s",
+			"Timeout":                        "10s",
+			"DeregisterCriticalServiceAfter": "1m40s",
+		},
+	}) {
+		t.Error("bad registration:", body)
+	}
+}
+
+func TestConsulCatalog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/catalog/services" {
+			t.Error("invalid path:", req.URL.Path)
+		}
+		res.Write([]byte(`{"consul":[],"host-1":["A","B"],"host-2":[]}`))
+	}))
+	defer server.Close()
+
+	names, err := consulCatalog{address: server.URL}.services()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(names)
+
+	if !reflect.DeepEqual(names, []string{"consul", "host-1", "host-2"}) {
+		t.Error("bad services:", names)
+	}
+}
 
+func TestConsulRegistrationRetry(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	reg := consulRegistration{
+		address: server.URL,
+		id:      "consul-router-host-4000",
+		name:    "consul-router",
+		port:    4000,
+	}
+
+	t.Run("registered", func(t *testing.T) {
+		if err := reg.keepRegistering(make(chan struct{}), time.Millisecond, 2*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := atomic.LoadInt32(&attempts); n != 3 {
+			t.Error("bad number of attempts:", n)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		reg := reg
+		reg.address = "http://127.0.0.1:0"
+
+		stop := make(chan struct{})
+		close(stop)
+
+		if err := reg.keepRegistering(stop, time.Hour, time.Hour); err == nil {
+			t.Error("registering an unreachable agent succeeded")
+		}
+	})
 }
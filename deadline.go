@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// grpcTimeout is the header carrying the deadline of gRPC calls, see
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+const grpcTimeout = "Grpc-Timeout"
+
+// clientTimeout returns the time budget that the client set on the request in
+// header, or in the grpc-timeout header of gRPC calls, and the name of the
+// header that carried it. The timeout is zero if the client didn't set one or
+// set an invalid value.
+//
+// The budget is a duration in the format accepted by time.ParseDuration (for
+// example 1.5s or 250ms).
+func clientTimeout(hdr http.Header, header string) (time.Duration, string) {
+	if value := hdr.Get(grpcTimeout); len(value) != 0 {
+		if d, ok := parseGRPCTimeout(value); ok {
+			return d, grpcTimeout
+		}
+	}
+
+	if len(header) != 0 {
+		if value := hdr.Get(header); len(value) != 0 {
+			if d, err := time.ParseDuration(value); err == nil && d > 0 {
+				return d, header
+			}
+		}
+	}
+
+	return 0, ""
+}
+
+// setClientTimeout sets the remaining time budget of the request in header so
+// the service knows how long the client is willing to wait.
+func setClientTimeout(hdr http.Header, header string, remain time.Duration) {
+	if remain < time.Millisecond {
+		remain = time.Millisecond
+	}
+
+	if header == grpcTimeout {
+		hdr.Set(header, formatGRPCTimeout(remain))
+	} else {
+		hdr.Set(header, remain.Truncate(time.Millisecond).String())
+	}
+}
+
+// The units of grpc-timeout values, from the most to the least precise.
+var grpcTimeoutUnits = []struct {
+	unit byte
+	size time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// grpcTimeoutMax is the bound of grpc-timeout values, they have at most 8
+// digits.
+const grpcTimeoutMax = 100000000
+
+func parseGRPCTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+
+	for _, u := range grpcTimeoutUnits {
+		if u.unit == s[len(s)-1] {
+			// Values too large to be represented, like 99999999H, mean the
+			// client is willing to wait for as long as possible.
+			if n > uint64(math.MaxInt64/u.size) {
+				return math.MaxInt64, true
+			}
+			return time.Duration(n) * u.size, true
+		}
+	}
+
+	return 0, false
+}
+
+// formatGRPCTimeout formats d with the most precise unit that fits in a
+// grpc-timeout value.
+func formatGRPCTimeout(d time.Duration) string {
+	for _, u := range grpcTimeoutUnits {
+		if n := d / u.size; n < grpcTimeoutMax {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(grpcTimeoutMax-1) + "H"
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		hdr     http.Header
+		timeout time.Duration
+		header  string
+	}{
+		{"none", http.Header{}, 0, ""},
+		{"duration", http.Header{"X-Request-Timeout": {"1.5s"}}, 1500 * time.Millisecond, "X-Request-Timeout"},
+		{"invalid", http.Header{"X-Request-Timeout": {"soon"}}, 0, ""},
+		{"negative", http.Header{"X-Request-Timeout": {"-1s"}}, 0, ""},
+		{"grpc", http.Header{"Grpc-Timeout": {"250m"}}, 250 * time.Millisecond, "Grpc-Timeout"},
+		{"both", http.Header{"Grpc-Timeout": {"2S"}, "X-Request-Timeout": {"1s"}}, 2 * time.Second, "Grpc-Timeout"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeout, header := clientTimeout(test.hdr, "X-Request-Timeout")
+
+			if timeout != test.timeout {
+				t.Errorf("bad timeout: %s != %s", timeout, test.timeout)
+			}
+
+			if header != test.header {
+				t.Errorf("bad header: %q != %q", header, test.header)
+			}
+		})
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		d     time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"1", 0, false},
+		{"S", 0, false},
+		{"0S", 0, false},
+		{"10x", 0, false},
+		{"123456789S", 0, false},
+		{"100n", 100 * time.Nanosecond, true},
+		{"100u", 100 * time.Microsecond, true},
+		{"100m", 100 * time.Millisecond, true},
+		{"100S", 100 * time.Second, true},
+		{"100M", 100 * time.Minute, true},
+		{"100H", 100 * time.Hour, true},
+		{"99999999M", 99999999 * time.Minute, true},
+		{"99999999H", math.MaxInt64, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if d, ok := parseGRPCTimeout(test.value); d != test.d || ok != test.ok {
+				t.Errorf("%s, %t != %s, %t", d, ok, test.d, test.ok)
+			}
+		})
+	}
+
+	for _, d := range []time.Duration{time.Millisecond, 3 * time.Second, 100 * time.Second, 1000 * time.Hour} {
+		s := formatGRPCTimeout(d)
+
+		if x, ok := parseGRPCTimeout(s); !ok || x != d {
+			t.Errorf("%s: %s does not parse back (%s)", d, s, x)
+		}
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	capped := defaultServiceConfig
+	capped.maxRequestTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		header   string // header set by the client
+		value    string
+		defaults serviceConfig
+		budget   time.Duration // zero if the service gets no budget
+	}{
+		{
+			name:   "timeout header",
+			header: "X-Request-Timeout",
+			value:  "50ms",
+			budget: 50 * time.Millisecond,
+		},
+		{
+			name:   "grpc-timeout",
+			header: "Grpc-Timeout",
+			value:  "50m",
+			budget: 50 * time.Millisecond,
+		},
+		{
+			name:     "maximum without client timeout",
+			defaults: capped,
+		},
+		{
+			name:     "maximum below client timeout",
+			header:   "X-Request-Timeout",
+			value:    "10s",
+			defaults: capped,
+			budget:   50 * time.Millisecond,
+		},
+		{
+			name:     "grpc-timeout overflow",
+			header:   "Grpc-Timeout",
+			value:    "99999999H",
+			defaults: capped,
+			budget:   50 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received := make(chan http.Header, 1)
+
+			url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				received <- req.Header
+				<-req.Context().Done()
+			}), httpServerConfig{timeoutHeader: "x-request-timeout", defaults: test.defaults})
+			defer stop()
+
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Host = "host-1.local"
+
+			if len(test.header) != 0 {
+				req.Header.Set(test.header, test.value)
+			}
+
+			start := time.Now()
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusGatewayTimeout {
+				t.Error("bad status:", res.StatusCode)
+			}
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Error("the deadline wasn't enforced:", elapsed)
+			}
+
+			hdr := <-received
+
+			if test.budget == 0 {
+				for _, h := range []string{"X-Request-Timeout", "Grpc-Timeout"} {
+					if v := hdr.Get(h); len(v) != 0 {
+						t.Errorf("unexpected %s budget: %s", h, v)
+					}
+				}
+				return
+			}
+
+			var d time.Duration
+
+			if test.header == grpcTimeout {
+				d, _ = parseGRPCTimeout(hdr.Get(grpcTimeout))
+			} else {
+				d, _ = time.ParseDuration(hdr.Get(test.header))
+			}
+
+			if d <= 0 || d > test.budget {
+				t.Errorf("bad remaining budget: %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The errorPages type renders the bodies of error responses generated by the
+// router, as opposed to errors returned by the services which are forwarded
+// untouched.
+//
+// Clients get a JSON object, an HTML page or plain text depending on the Accept
+// header of their request. HTML pages are rendered from templates named after
+// the status code (404.html, 502.html, ...), default.html being used for
+// status codes that have no dedicated template.
+//
+// A nil *errorPages is valid and renders the built-in pages.
+type errorPages struct {
+	instance string
+	header   string
+	html     map[int]*template.Template
+	fallback *template.Template
+}
+
+type errorPagesConfig struct {
+	dir      string // directory holding the html templates, built-in pages are used when empty
+	instance string // name of the router instance reported in error responses
+	header   string // header carrying the instance name, not set when empty
+}
+
+// The errorPage structure carries the information made available to the
+// templates, and serialized in JSON error responses.
+type errorPage struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+}
+
+func (p errorPage) StatusText() string {
+	return http.StatusText(p.Status)
+}
+
+var defaultErrorTemplate = template.Must(template.New("default.html").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RequestID}}<p>Request ID: <code>{{.RequestID}}</code></p>
+{{end}}{{if .Instance}}<hr><address>{{.Instance}}</address>
+{{end}}</body>
+</html>
+`))
+
+func loadErrorPages(config errorPagesConfig) (*errorPages, error) {
+	p := &errorPages{
+		instance: config.instance,
+		header:   http.CanonicalHeaderKey(config.header),
+		html:     make(map[int]*template.Template),
+		fallback: defaultErrorTemplate,
+	}
+
+	if len(config.dir) == 0 {
+		return p, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(config.dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Base(file)
+		tpl, err := template.New(name).Parse(string(b))
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "default.html" {
+			p.fallback = tpl
+			continue
+		}
+
+		status, err := strconv.Atoi(strings.TrimSuffix(name, ".html"))
+		if err != nil || status < 400 || status > 599 {
+			return nil, &os.PathError{Op: "load", Path: file, Err: errBadErrorPage}
+		}
+
+		p.html[status] = tpl
+	}
+
+	return p, nil
+}
+
+var errBadErrorPage = errors.New("error page templates must be named <status>.html or default.html")
+
+// write sends an error response for page to w, the format is negotiated from
+// the Accept header of req. gRPC calls get a gRPC status instead.
+func (p *errorPages) write(w http.ResponseWriter, req *http.Request, page errorPage) {
+	var b bytes.Buffer
+	var contentType string
+
+	tpl := defaultErrorTemplate
+
+	if p != nil {
+		page.Instance = p.instance
+
+		if len(p.header) != 0 && len(p.instance) != 0 {
+			w.Header().Set(p.header, p.instance)
+		}
+
+		if tpl = p.html[page.Status]; tpl == nil {
+			tpl = p.fallback
+		}
+	}
+
+	if isGRPC(req.Header.Get("Content-Type")) {
+		writeGRPCError(w, page)
+		return
+	}
+
+	switch negotiate(req.Header.Get("Accept"), "application/json", "text/html", "text/plain") {
+	case "text/html":
+		if err := tpl.Execute(&b, page); err == nil {
+			contentType = "text/html; charset=utf-8"
+			break
+		}
+		b.Reset()
+		fallthrough
+
+	case "text/plain":
+		contentType = "text/plain; charset=utf-8"
+		b.WriteString(strconv.Itoa(page.Status) + " " + page.StatusText() + ": " + page.Message + "\n")
+
+	default:
+		contentType = "application/json"
+		json.NewEncoder(&b).Encode(page)
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", contentType)
+	hdr.Set("Content-Length", strconv.Itoa(b.Len()))
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(page.Status)
+
+	if req.Method != "HEAD" {
+		w.Write(b.Bytes())
+	}
+}
+
+// negotiate returns the offer that best matches the accept header, the first
+// offer is returned if the header is empty or accepts none of the offers.
+func negotiate(accept string, offers ...string) string {
+	if len(accept) == 0 {
+		return offers[0]
+	}
+
+	best, bestQ, bestSpecificity := offers[0], -1.0, -1
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseAcceptPart(part)
+
+		if q <= 0 {
+			continue
+		}
+
+		for _, offer := range offers {
+			specificity := -1
+
+			switch {
+			case mediaType == offer:
+				specificity = 2
+			case mediaType == "*/*":
+				specificity = 0
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, mediaType[:len(mediaType)-1]):
+				specificity = 1
+			}
+
+			// Offers matched by wildcards only win if nothing matched more
+			// explicitly, the order of offers breaks ties.
+			if specificity >= 0 && (q > bestQ || (q == bestQ && specificity > bestSpecificity)) {
+				best, bestQ, bestSpecificity = offer, q, specificity
+			}
+		}
+	}
+
+	return best
+}
+
+func parseAcceptPart(part string) (mediaType string, q float64) {
+	q = 1
+	params := strings.Split(part, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(params[0]))
+
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+
+		if strings.HasPrefix(param, "q=") {
+			if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = v
+			}
+		}
+	}
+
+	return
+}
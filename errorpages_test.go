@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/html", "text/plain"}
+
+	tests := []struct {
+		accept string
+		offer  string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/html", "text/html"},
+		{"text/*", "text/html"},
+		{"text/plain, text/*;q=0.5", "text/plain"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+		{"application/json;q=0.5, text/html;q=0.9", "text/html"},
+		{"text/html;q=0, */*", "application/json"},
+		{"image/png", "application/json"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			if offer := negotiate(test.accept, offers...); offer != test.offer {
+				t.Errorf("%s != %s", offer, test.offer)
+			}
+		})
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "404.html"), []byte(`not found: {{.Service}}`), 0644)
+
+	pages, err := loadErrorPages(errorPagesConfig{
+		dir:      dir,
+		instance: "router-1",
+		header:   "x-router-instance",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := errorPage{
+		Status:    http.StatusNotFound,
+		Code:      requestNotFound,
+		Message:   "no service is registered under the requested host",
+		RequestID: "1234",
+		Service:   "host-1",
+	}
+
+	tests := []struct {
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"application/json", http.StatusNotFound, "application/json", `"code":"not_found"`},
+		{"text/html", http.StatusNotFound, "text/html; charset=utf-8", "not found: host-1"},
+		{"text/plain", http.StatusNotFound, "text/plain; charset=utf-8", "404 Not Found: no service is registered"},
+		{"text/html", http.StatusBadGateway, "text/html; charset=utf-8", "<h1>502 Bad Gateway</h1>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept", test.accept)
+			res := httptest.NewRecorder()
+
+			p := page
+			p.Status = test.status
+			pages.write(res, req, p)
+
+			if res.Code != test.status {
+				t.Error("bad status:", res.Code)
+			}
+
+			if contentType := res.Header().Get("Content-Type"); contentType != test.contentType {
+				t.Error("bad content type:", contentType)
+			}
+
+			if instance := res.Header().Get("X-Router-Instance"); instance != "router-1" {
+				t.Error("bad instance:", instance)
+			}
+
+			if body := res.Body.String(); !strings.Contains(body, test.body) {
+				t.Errorf("%q doesn't contain %q", body, test.body)
+			}
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		res := httptest.NewRecorder()
+		pages.write(res, req, page)
+
+		var p errorPage
+		json.NewDecoder(res.Body).Decode(&p)
+
+		page.Instance = "router-1"
+		if p != page {
+			t.Errorf("%#v != %#v", p, page)
+		}
+	})
+}
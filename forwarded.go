@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The trustedProxies type is a list of networks from which the router accepts
+// forwarding headers. Requests coming from other addresses have their
+// Forwarded and X-Forwarded-* headers stripped before being forwarded, so
+// clients cannot spoof them.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of CIDRs, plain addresses
+// are accepted as well and interpreted as single host networks.
+func parseTrustedProxies(s string) (trusted trustedProxies, err error) {
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); len(cidr) == 0 {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		var network *net.IPNet
+
+		if _, network, err = net.ParseCIDR(cidr); err != nil {
+			return
+		}
+
+		trusted = append(trusted, network)
+	}
+	return
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders adds the router to the Forwarded, X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host headers of req.
+//
+// When the request comes from a trusted proxy the router appends itself to the
+// existing headers, otherwise it discards them and starts new ones.
+func setForwardedHeaders(req *http.Request, trusted trustedProxies) {
+	hdr := req.Header
+	addr := remoteIP(req.RemoteAddr)
+
+	if addr == nil || !trusted.contains(addr) {
+		hdr.Del("Forwarded")
+		hdr.Del("X-Forwarded-For")
+		hdr.Del("X-Forwarded-Proto")
+		hdr.Del("X-Forwarded-Host")
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	hdr["Forwarded"] = []string{joinHeaderValues(hdr["Forwarded"], forwarded(req, proto))}
+
+	if addr != nil {
+		hdr["X-Forwarded-For"] = []string{joinHeaderValues(hdr["X-Forwarded-For"], addr.String())}
+	}
+
+	// The protocol and host reflect what the original client used, they are
+	// only set by the first proxy.
+	if len(hdr.Get("X-Forwarded-Proto")) == 0 {
+		hdr.Set("X-Forwarded-Proto", proto)
+	}
+
+	if len(hdr.Get("X-Forwarded-Host")) == 0 {
+		hdr.Set("X-Forwarded-Host", req.Host)
+	}
+}
+
+// forwarded returns the forwarded-element describing the hop from the client
+// to the router, see https://tools.ietf.org/html/rfc7239#section-4
+func forwarded(req *http.Request, proto string) string {
+	return "for=" + forwardedNode(req.RemoteAddr) + ";host=" + quote(req.Host) + ";proto=" + proto
+}
+
+// forwardedNode formats addr as a node identifier, IPv6 addresses must be
+// enclosed in square brackets, see https://tools.ietf.org/html/rfc7239#section-6
+func forwardedNode(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		host, port = addr, ""
+	}
+
+	if len(host) == 0 {
+		return "unknown"
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if len(port) != 0 {
+		host += ":" + port
+	}
+
+	return quote(host)
+}
+
+func remoteIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+func joinHeaderValues(values []string, value string) string {
+	if len(values) == 0 {
+		return value
+	}
+	return strings.Join(values, ", ") + ", " + value
+}
+
+// quote returns s unchanged if it is a valid token, or as a quoted-string
+// otherwise, see https://tools.ietf.org/html/rfc7230#section-3.2.6
+func quote(s string) string {
+	if len(s) != 0 && strings.IndexFunc(s, isNotTokenChar) < 0 {
+		return s
+	}
+
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+
+	for i := 0; i != len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c == '\t' || (c >= ' ' && c != 0x7f):
+			b = append(b, c)
+		}
+	}
+
+	return string(append(b, '"'))
+}
+
+func isNotTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		in     http.Header
+		out    http.Header
+	}{
+		{
+			name:   "untrusted",
+			remote: "1.2.3.4:5678",
+			in: http.Header{
+				"Forwarded":        {"for=6.6.6.6"},
+				"X-Forwarded-For":  {"6.6.6.6"},
+				"X-Forwarded-Host": {"evil.com"},
+			},
+			out: http.Header{
+				"Forwarded":         {`for="1.2.3.4:5678";host=host-1.local;proto=http`},
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"host-1.local"},
+			},
+		},
+		{
+			name:   "trusted",
+			remote: "10.1.2.3:5678",
+			in: http.Header{
+				"Forwarded":         {"for=1.2.3.4;proto=https", "for=5.6.7.8"},
+				"X-Forwarded-For":   {"1.2.3.4, 5.6.7.8"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+			},
+			out: http.Header{
+				"Forwarded":         {`for=1.2.3.4;proto=https, for=5.6.7.8, for="10.1.2.3:5678";host=host-1.local;proto=http`},
+				"X-Forwarded-For":   {"1.2.3.4, 5.6.7.8, 10.1.2.3"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+			},
+		},
+		{
+			name:   "ipv6",
+			remote: "[2001:db8:cafe::17]:4711",
+			in:     http.Header{},
+			out: http.Header{
+				"Forwarded":         {`for="[2001:db8:cafe::17]:4711";host=host-1.local;proto=http`},
+				"X-Forwarded-For":   {"2001:db8:cafe::17"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"host-1.local"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://host-1.local/", nil)
+			req.RemoteAddr = test.remote
+			req.Header = test.in
+
+			setForwardedHeaders(req, trusted)
+
+			if !reflect.DeepEqual(req.Header, test.out) {
+				t.Errorf("\n%#v\n%#v", req.Header, test.out)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"", `""`},
+		{"token", "token"},
+		{"host-1.local", "host-1.local"},
+		{"host-1.local:80", `"host-1.local:80"`},
+		{`a "b" \c`, `"a \"b\" \\c"`},
+		{"a\x00b", `"ab"`},
+	}
+
+	for _, test := range tests {
+		if out := quote(test.in); out != test.out {
+			t.Errorf("%q: %s != %s", test.in, out, test.out)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes reported by the router when it fails to forward a call,
+// see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnimplemented     = 12
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnknown           = 2
+)
+
+// isGRPC returns true if contentType is the one of a gRPC call.
+func isGRPC(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcStatus maps the status code of an error generated by the router to the
+// gRPC status code reported to clients, following the mapping that gRPC
+// clients use for HTTP responses, see
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcStatus(status int) int {
+	switch status {
+	case http.StatusNotFound, http.StatusNotImplemented:
+		return grpcUnimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusRequestEntityTooLarge:
+		return grpcResourceExhausted
+	case http.StatusInternalServerError:
+		return grpcInternal
+	default:
+		return grpcUnknown
+	}
+}
+
+// writeGRPCError sends a trailers-only response carrying the gRPC status that
+// matches page. gRPC responses always have a 200 status, errors are reported
+// in the grpc-status and grpc-message fields.
+func writeGRPCError(w http.ResponseWriter, page errorPage) {
+	hdr := w.Header()
+	hdr.Set("Content-Type", "application/grpc")
+	hdr.Set("Grpc-Status", strconv.Itoa(grpcStatus(page.Status)))
+	hdr.Set("Grpc-Message", grpcEncodeMessage(page.Message))
+	hdr.Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEncodeMessage percent-encodes msg as required for the grpc-message field.
+func grpcEncodeMessage(msg string) string {
+	const hex = "0123456789ABCDEF"
+	b := make([]byte, 0, len(msg))
+
+	for i := 0; i != len(msg); i++ {
+		if c := msg[i]; c >= ' ' && c <= '~' && c != '%' {
+			b = append(b, c)
+		} else {
+			b = append(b, '%', hex[c>>4], hex[c&0xF])
+		}
+	}
+
+	return string(b)
+}
+
+// acceptsTrailers returns true if the TE field of hdr lists trailers.
+func acceptsTrailers(hdr http.Header) bool {
+	for _, value := range hdr["Te"] {
+		for _, part := range strings.Split(value, ",") {
+			if i := strings.IndexByte(part, ';'); i >= 0 {
+				part = part[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(part), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		code   int
+	}{
+		{http.StatusNotFound, grpcUnimplemented},
+		{http.StatusBadGateway, grpcUnavailable},
+		{http.StatusServiceUnavailable, grpcUnavailable},
+		{http.StatusGatewayTimeout, grpcDeadlineExceeded},
+		{http.StatusInternalServerError, grpcInternal},
+		{http.StatusTeapot, grpcUnknown},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			if code := grpcStatus(test.status); code != test.code {
+				t.Errorf("%d != %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestGRPCEncodeMessage(t *testing.T) {
+	tests := []struct {
+		msg string
+		enc string
+	}{
+		{"", ""},
+		{"no service", "no service"},
+		{"100%", "100%25"},
+		{"a\nb", "a%0Ab"},
+		{"é", "%C3%A9"},
+	}
+
+	for _, test := range tests {
+		if enc := grpcEncodeMessage(test.msg); enc != test.enc {
+			t.Errorf("%q: %q != %q", test.msg, enc, test.enc)
+		}
+	}
+}
+
+func TestAcceptsTrailers(t *testing.T) {
+	tests := []struct {
+		te []string
+		ok bool
+	}{
+		{nil, false},
+		{[]string{"gzip"}, false},
+		{[]string{"trailers"}, true},
+		{[]string{"gzip, Trailers;q=1"}, true},
+		{[]string{"gzip", "trailers"}, true},
+	}
+
+	for _, test := range tests {
+		if ok := acceptsTrailers(http.Header{"Te": test.te}); ok != test.ok {
+			t.Errorf("%q: %t != %t", test.te, ok, test.ok)
+		}
+	}
+}
+
+func TestGRPCError(t *testing.T) {
+	// The endpoint of the unreachable service refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	tests := []struct {
+		name     string
+		host     string
+		trailers bool // send Te: trailers
+		status   string
+	}{
+		{"unknown service", "host-0", true, "12"},
+		{"unreachable service", "host-1", true, "14"},
+		{"no healthy endpoints", "host-2", true, "14"},
+		{"timeout", "host-3", true, "4"},
+		{"without te trailers", "host-0", false, "12"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// host-3 is served by the backend, it never responds and the
+			// router gives up after the read timeout. The body is read so
+			// the backend notices when the router closes the connection.
+			url, stop := newTestRouter(t, "host-3", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				ioutil.ReadAll(req.Body)
+				<-req.Context().Done()
+			}), httpServerConfig{
+				source: configMap{"host-3": {"read-timeout": "50ms"}},
+			}, withFrontendProtocol(protoH2C), withResolver(func(name string) ([]service, error) {
+				switch name {
+				case "host-1":
+					return []service{{host, p, nil}}, nil
+				case "host-2":
+					return nil, errNoHealthyEndpoints
+				default:
+					return nil, errUnknownService
+				}
+			}))
+			defer stop()
+
+			req, _ := http.NewRequest("POST", url+"/pkg.Service/Method", nil)
+			req.Host = test.host + ".local"
+			req.Header.Set("Content-Type", "application/grpc")
+
+			if test.trailers {
+				req.Header.Set("Te", "trailers")
+			}
+
+			res, err := transportFor(protoH2C).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Error("bad status:", res.StatusCode)
+			}
+
+			if ct := res.Header.Get("Content-Type"); ct != "application/grpc" {
+				t.Errorf("bad content type: %q", ct)
+			}
+
+			if status := res.Header.Get("Grpc-Status"); status != test.status {
+				t.Errorf("bad grpc status: %q != %q", status, test.status)
+			}
+
+			if msg := res.Header.Get("Grpc-Message"); len(msg) == 0 {
+				t.Error("missing grpc message")
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The healthServer type is a http handler reporting the health of the router
+// to load balancers and orchestrators.
+//
+// The following endpoints are supported:
+//
+//	GET /health/live    200 as long as the process is running
+//	GET /health/ready   200 when the router can serve traffic, 503 otherwise
+//	GET /health/detail  JSON report of the router state and its dependencies
+//	GET /               same as /health/ready
+//
+// The router is not ready while draining, or when the consul agent didn't
+// answer within the configured window. The detailed report tells routers that
+// are still starting apart from routers that lost their consul agent.
+type healthServer struct {
+	start    time.Time
+	server   *httpServer
+	consul   string
+	window   time.Duration
+	mux      *http.ServeMux
+	done     chan struct{}
+	draining uint32 // atomic flag
+	contact  int64  // atomic, time of the last answer from consul in unix nanoseconds
+}
+
+type healthServerConfig struct {
+	server *httpServer // nil if the http server is disabled
+	consul string      // empty if no consul agent is configured
+	window time.Duration
+}
+
+// Health states reported by the router.
+const (
+	healthStarting    = "starting"
+	healthReady       = "ready"
+	healthDraining    = "draining"
+	healthUnavailable = "unavailable"
+)
+
+// minHealthWindow is the shortest window accepted by the health server, the
+// consul agent is probed three times per window.
+const minHealthWindow = 1 * time.Second
+
+func newHealthServer(config healthServerConfig) *healthServer {
+	if config.window < minHealthWindow {
+		config.window = minHealthWindow
+	}
+
+	h := &healthServer{
+		start:  time.Now(),
+		server: config.server,
+		consul: config.consul,
+		window: config.window,
+		mux:    http.NewServeMux(),
+		done:   make(chan struct{}),
+	}
+	h.mux.HandleFunc("/health/live", h.serveLive)
+	h.mux.HandleFunc("/health/ready", h.serveReady)
+	h.mux.HandleFunc("/health/detail", h.serveDetail)
+	h.mux.HandleFunc("/", h.serveReady)
+
+	if len(h.consul) != 0 {
+		go h.run()
+	}
+
+	return h
+}
+
+func (h *healthServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(w, req)
+}
+
+func (h *healthServer) close() {
+	close(h.done)
+}
+
+// setDraining marks the router as draining, it stops being ready so load
+// balancers send traffic to other instances.
+func (h *healthServer) setDraining() {
+	atomic.StoreUint32(&h.draining, 1)
+}
+
+func (h *healthServer) run() {
+	// Probing a few times per window ensures a single slow answer doesn't
+	// mark the router as unavailable.
+	ticker := time.NewTicker(h.window / 3)
+	defer ticker.Stop()
+
+	for {
+		h.probe()
+
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthServer) probe() {
+	var leader string
+
+	// A probe that doesn't complete before the next one is due is a failure,
+	// a hung agent must not stall the loop.
+	ctx, cancel := context.WithTimeout(context.Background(), h.window/3)
+	defer cancel()
+
+	if _, err := consulGetContext(ctx, consulURL(h.consul, "/v1/status/leader"), &leader); err == nil {
+		atomic.StoreInt64(&h.contact, time.Now().UnixNano())
+	}
+}
+
+// lastContact returns the time at which the consul agent last answered, the
+// zero value is returned if it never did.
+func (h *healthServer) lastContact() time.Time {
+	if t := atomic.LoadInt64(&h.contact); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+func (h *healthServer) state(now time.Time) string {
+	if atomic.LoadUint32(&h.draining) != 0 {
+		return healthDraining
+	}
+
+	if len(h.consul) != 0 {
+		contact := h.lastContact()
+
+		switch {
+		case contact.IsZero() && now.Sub(h.start) < h.window:
+			return healthStarting
+		case contact.IsZero() || now.Sub(contact) > h.window:
+			return healthUnavailable
+		}
+	}
+
+	return healthReady
+}
+
+func (h *healthServer) serveLive(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *healthServer) serveReady(w http.ResponseWriter, req *http.Request) {
+	if h.state(time.Now()) != healthReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type healthDetail struct {
+	Status   string        `json:"status"`
+	Uptime   float64       `json:"uptime"`
+	Consul   *healthConsul `json:"consul,omitempty"`
+	Cache    int           `json:"cache_size"`
+	InFlight int64         `json:"in_flight"`
+}
+
+type healthConsul struct {
+	Address     string     `json:"address"`
+	Reachable   bool       `json:"reachable"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+func (h *healthServer) serveDetail(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	detail := healthDetail{
+		Status: h.state(now),
+		Uptime: now.Sub(h.start).Seconds(),
+	}
+
+	if len(h.consul) != 0 {
+		contact := h.lastContact()
+		detail.Consul = &healthConsul{
+			Address:   h.consul,
+			Reachable: !contact.IsZero() && now.Sub(contact) <= h.window,
+		}
+		if !contact.IsZero() {
+			detail.Consul.LastContact = &contact
+		}
+	}
+
+	if h.server != nil {
+		detail.Cache = h.server.cache.len()
+		detail.InFlight = h.server.inFlight()
+	}
+
+	status := http.StatusOK
+	if detail.Status != healthReady {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, detail)
+}
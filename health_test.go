@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthState(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		consul   string
+		start    time.Time
+		contact  time.Time
+		draining bool
+		state    string
+	}{
+		{"no consul", "", now.Add(-time.Hour), time.Time{}, false, healthReady},
+		{"starting", "consul", now, time.Time{}, false, healthStarting},
+		{"never reached", "consul", now.Add(-time.Hour), time.Time{}, false, healthUnavailable},
+		{"lost", "consul", now.Add(-time.Hour), now.Add(-time.Minute), false, healthUnavailable},
+		{"ready", "consul", now.Add(-time.Hour), now, false, healthReady},
+		{"draining", "consul", now.Add(-time.Hour), now, true, healthDraining},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &healthServer{
+				start:  test.start,
+				consul: test.consul,
+				window: 10 * time.Second,
+			}
+
+			if !test.contact.IsZero() {
+				h.contact = test.contact.UnixNano()
+			}
+
+			if test.draining {
+				h.setDraining()
+			}
+
+			if state := h.state(now); state != test.state {
+				t.Errorf("bad state: %s != %s", state, test.state)
+			}
+		})
+	}
+}
+
+func TestHealthServer(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/status/leader" {
+			t.Error("invalid path:", req.URL.Path)
+		}
+		res.Write([]byte(`"127.0.0.1:8300"`))
+	}))
+	defer consul.Close()
+
+	h := newHealthServer(healthServerConfig{
+		consul: consul.URL,
+		window: 10 * time.Second,
+	})
+	defer h.close()
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	// Wait for the first probe to reach the consul agent.
+	for i := 0; i != 100 && h.lastContact().IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/", http.StatusOK},
+		{"/health/live", http.StatusOK},
+		{"/health/ready", http.StatusOK},
+		{"/health/detail", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, err := http.Get(server.URL + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("bad status: %d != %d", res.StatusCode, test.status)
+			}
+		})
+	}
+
+	h.setDraining()
+
+	res, err := http.Get(server.URL + "/health/detail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var detail healthDetail
+	json.NewDecoder(res.Body).Decode(&detail)
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Error("bad status:", res.StatusCode)
+	}
+
+	if detail.Status != healthDraining {
+		t.Error("bad state:", detail.Status)
+	}
+
+	if detail.Consul == nil || !detail.Consul.Reachable {
+		t.Error("the consul agent should be reported as reachable:", detail.Consul)
+	}
+
+	res, err = http.Get(server.URL + "/health/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Error("the router should still be live while draining:", res.StatusCode)
+	}
+}
+
+func TestHealthProbeTimeout(t *testing.T) {
+	consul := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer consul.Close()
+
+	// The window is raised to the minimum, probes time out after a third. The
+	// agent is set after creating the server so only this test probes it.
+	h := newHealthServer(healthServerConfig{})
+	defer h.close()
+	h.consul = consul.URL
+
+	if h.window != minHealthWindow {
+		t.Error("the window wasn't raised to the minimum:", h.window)
+	}
+
+	start := time.Now()
+	h.probe()
+
+	if elapsed := time.Since(start); elapsed > h.window {
+		t.Error("the probe didn't time out:", elapsed)
+	}
+
+	if !h.lastContact().IsZero() {
+		t.Error("a failed probe was counted as a contact")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -11,44 +13,78 @@ import (
 	"time"
 
 	"github.com/apex/log"
+	"github.com/segmentio/stats"
 )
 
 // The httpServer type is a http handler that proxies requests and uses a
 // resolver to lookup the address to which it should send the requests.
 type httpServer struct {
-	domain    string
-	blacklist *blacklist
-	cache     *cache
-	rslv      resolver
-	join      sync.WaitGroup
-	stop      uint32 // atomic flag
+	domain      string
+	blacklist   *blacklist
+	cache       *cache
+	config      *serviceConfigs
+	accessLog   *accessLogger
+	tracer      *tracer
+	requestID   string
+	timeout     string
+	trusted     trustedProxies
+	errorPages  *errorPages
+	compression *compression
+	rslv        resolver
+	join        sync.WaitGroup
+	stop        uint32 // atomic flag
+	inflight    int64  // atomic counter
 }
 
 type httpServerConfig struct {
-	stop         <-chan struct{}
-	done         chan<- struct{}
-	rslv         resolver
-	domain       string
-	prefer       string
-	cacheTimeout time.Duration
+	stop                 <-chan struct{}
+	done                 chan<- struct{}
+	rslv                 resolver
+	source               configSource
+	accessLog            *accessLogger
+	tracer               *tracer
+	requestID            string
+	timeoutHeader        string
+	trusted              trustedProxies
+	errorPages           *errorPages
+	compression          *compression
+	domain               string
+	defaults             serviceConfig
+	cacheTimeout         time.Duration
+	cacheNegativeTimeout time.Duration
+	cacheMaxStale        time.Duration
+	cacheSize            int
 }
 
 func newHttpServer(config httpServerConfig) *httpServer {
-	c := cached(config.cacheTimeout, config.rslv)
+	c := cached(cacheConfig{
+		timeout:         config.cacheTimeout,
+		negativeTimeout: config.cacheNegativeTimeout,
+		maxStale:        config.cacheMaxStale,
+		size:            config.cacheSize,
+	}, config.rslv)
 	b := blacklisted(config.cacheTimeout, c)
 	s := &httpServer{
-		domain:    config.domain,
-		blacklist: b,
-		cache:     c,
-		rslv:      preferred(config.prefer, b),
+		domain:      config.domain,
+		blacklist:   b,
+		cache:       c,
+		config:      configured(config.cacheTimeout, config.defaults, config.source),
+		accessLog:   config.accessLog,
+		tracer:      config.tracer,
+		requestID:   http.CanonicalHeaderKey(config.requestID),
+		timeout:     http.CanonicalHeaderKey(config.timeoutHeader),
+		trusted:     config.trusted,
+		errorPages:  config.errorPages,
+		compression: config.compression,
+		rslv:        b,
 	}
 
 	go func(s *httpServer, stop <-chan struct{}, done chan<- struct{}) {
 		// Wait for a stop signal, when it arrives the server is marked for
 		// graceful shutdown and waits for in-flight requests to complete.
-		// Note that this is not a perfect graceful shutdown and there may still
-		// be some race conditions where requests are dropped but it's the best
-		// we can do considering the current net/http API.
+		// Closing listeners and idle connections is left to http.Server's
+		// Shutdown method, requests that are already being read are served
+		// normally instead of being dropped.
 		<-stop
 		s.setStopped()
 		s.join.Wait()
@@ -62,24 +98,111 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.join.Add(1)
 	defer s.join.Done()
 
-	// When the server is stopped we break here returning a 503.
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	// Per-service metrics are only reported once the name is known to resolve
+	// so unknown hostnames don't create new series.
+	var service string
+	var endpoint string
+	var attempts int
+	var upstream time.Duration
+	var outcome = requestOK
+	var start = time.Now()
+	var rw = &httpResponseWriter{ResponseWriter: w}
+	var body = &httpBodyReader{Reader: req.Body}
+	var uri = req.RequestURI
+	var trace = s.tracer.start(req)
+	var requestID = s.setRequestID(req, w)
+	var logger = log.WithFields(log.Fields{
+		"request_id": requestID,
+		"client":     req.RemoteAddr,
+	})
+	w, req.Body = rw, body
+
+	// Errors generated by the router are rendered with the configured error
+	// pages, the outcome is used as error code.
+	fail := func(status int, message string) {
+		s.errorPages.write(w, req, errorPage{
+			Status:    status,
+			Code:      outcome,
+			Message:   message,
+			RequestID: requestID,
+			Service:   service,
+		})
+	}
+
+	// Requests that the client canceled, or that ran out of time, are not
+	// forwarded anymore. Clients that went away get no response, the status
+	// code is only reported in logs and metrics.
+	abort := func(err error) {
+		if err == context.DeadlineExceeded {
+			outcome = requestTimeout
+			fail(http.StatusGatewayTimeout, "the request deadline was exceeded")
+		} else {
+			outcome = requestAborted
+			rw.status = statusClientClosedRequest
+		}
+		logger.WithFields(log.Fields{
+			"host":     req.Host,
+			"service":  service,
+			"attempts": attempts,
+			"error":    err,
+		}).Info("the request was aborted before a response was received")
+	}
+
+	defer func() {
+		observeRequest(start, service, outcome)
+
+		trace.set("http.host", req.Host)
+		trace.set("http.target", uri)
+		trace.set("http.status_code", strconv.Itoa(rw.status))
+		trace.set("router.outcome", outcome)
+		trace.set("router.service", service)
+		trace.finish()
+
+		if s.accessLog != nil {
+			s.accessLog.log(&accessLogEntry{
+				time:      start,
+				remote:    req.RemoteAddr,
+				method:    req.Method,
+				host:      req.Host,
+				uri:       uri,
+				proto:     req.Proto,
+				referer:   req.Referer(),
+				userAgent: req.UserAgent(),
+				requestID: requestID,
+				service:   service,
+				endpoint:  endpoint,
+				status:    rw.status,
+				bytesIn:   int64(body.n),
+				bytesOut:  rw.n,
+				attempts:  attempts,
+				upstream:  upstream,
+				latency:   time.Since(start),
+			})
+		}
+	}()
+
+	// When the server is draining the request is still served, but the client
+	// is asked to close the connection so it reconnects to another router.
 	if s.stopped() {
 		w.Header().Add("Connection", "close")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return
 	}
 
 	// If this is a request for a protocol upgrade we open a new tcp connection
 	// to the service.
 	if len(req.Header.Get("Upgrade")) != 0 {
 		// TODO: support protocol upgrades
-		w.WriteHeader(http.StatusNotImplemented)
+		outcome = requestUnsupported
+		fail(http.StatusNotImplemented, "protocol upgrades are not supported")
 		return
 	}
 
 	if !strings.HasSuffix(req.Host, s.domain) {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		log.WithFields(log.Fields{
+		outcome = requestWrongDomain
+		fail(http.StatusServiceUnavailable, "the requested host doesn't belong to the domain served by the router")
+		logger.WithFields(log.Fields{
 			"status": http.StatusServiceUnavailable,
 			"reason": http.StatusText(http.StatusServiceUnavailable),
 			"host":   req.Host,
@@ -90,25 +213,98 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	host := req.Host
 	name := host[:len(host)-len(s.domain)]
+	trailers := acceptsTrailers(req.Header)
 	clearConnectionFields(req.Header)
 	clearHopByHopFields(req.Header)
 	clearRequestMetadata(req)
+	setForwardedHeaders(req, s.trusted)
+
+	// The router forwards trailers, so it can tell services that the client
+	// accepts them. gRPC services require it.
+	if trailers {
+		req.Header.Set("Te", "trailers")
+	}
 
 	// Forward the request to the resolved hostname, connection errors are
 	// retried on idempotent methods, only if no bytes of the body have been
 	// transfered yet.
-	const maxAttempts = 10
 	var res *http.Response
+	var cfg serviceConfig
+	var budget string    // header carrying the time budget of the request
+	var forwardErr error // error of the last attempt at forwarding the request
+
+	forwardFailed := func(err error) {
+		if err == errUpstreamTimeout {
+			outcome = requestTimeout
+			fail(http.StatusGatewayTimeout, "the service didn't respond in time")
+			logger.WithFields(log.Fields{
+				"status": http.StatusGatewayTimeout,
+				"reason": http.StatusText(http.StatusGatewayTimeout),
+				"host":   host,
+				"error":  err,
+			}).Error("the service didn't respond before the read timeout")
+			return
+		}
 
-	body := &httpBodyReader{Reader: req.Body}
-	req.Body = body
+		outcome = requestForwardError
+		fail(http.StatusBadGateway, "the router failed to forward the request to the service")
+		logger.WithFields(log.Fields{
+			"status": http.StatusBadGateway,
+			"reason": http.StatusText(http.StatusBadGateway),
+			"host":   host,
+			"error":  err,
+		}).Error("forwarding the request to the service returned an error")
+	}
 
 	for attempt := 0; true; attempt++ {
+		resolveSpan := trace.child("resolve", spanInternal)
+		resolveSpan.set("router.service", name)
 		srv, err := s.rslv.resolve(name)
+		resolveSpan.fail(err)
+		resolveSpan.finish()
+
+		switch {
+		case err == errUnknownService || (err == nil && len(srv) == 0):
+			outcome = requestNotFound
+			fail(http.StatusNotFound, "no service is registered under the requested host")
+			logger.WithFields(log.Fields{
+				"status": http.StatusNotFound,
+				"reason": http.StatusText(http.StatusNotFound),
+				"host":   host,
+			}).Info("the requested service could not be found")
+			return
+
+		case err == errUnknownLimit:
+			outcome = requestUnknownLimit
+			w.Header().Set("Retry-After", "1")
+			fail(http.StatusServiceUnavailable, "too many requests for unknown services, try again later")
+			logger.WithFields(log.Fields{
+				"status": http.StatusServiceUnavailable,
+				"reason": http.StatusText(http.StatusServiceUnavailable),
+				"host":   host,
+			}).Warn("the requested service was not looked up because too many unknown services were queried")
+			return
+
+		case err == errNoHealthyEndpoints && forwardErr != nil:
+			// The previous attempts black-listed every endpoint of the
+			// service, the client gets the error of the last one.
+			forwardFailed(forwardErr)
+			return
+
+		case err == errNoHealthyEndpoints:
+			outcome = requestUnhealthy
+			fail(http.StatusServiceUnavailable, "none of the service endpoints are healthy")
+			logger.WithFields(log.Fields{
+				"status": http.StatusServiceUnavailable,
+				"reason": http.StatusText(http.StatusServiceUnavailable),
+				"host":   host,
+			}).Error("all endpoints of the service are black-listed")
+			return
 
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.WithFields(log.Fields{
+		case err != nil:
+			outcome = requestResolverError
+			fail(http.StatusInternalServerError, "the router failed to resolve the requested host")
+			logger.WithFields(log.Fields{
 				"status": http.StatusInternalServerError,
 				"reason": http.StatusText(http.StatusInternalServerError),
 				"host":   host,
@@ -117,48 +313,145 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if len(srv) == 0 {
-			w.WriteHeader(http.StatusBadGateway)
-			log.WithFields(log.Fields{
-				"status": http.StatusBadGateway,
-				"reason": http.StatusText(http.StatusBadGateway),
-				"host":   host,
-			}).Error("no service returned by the resolver")
-			return
+		// The service configuration is only looked up once the name is known
+		// to resolve, this way unknown hostnames don't get tracked.
+		if attempt == 0 {
+			service = name
+			cfg = s.config.lookup(name)
+
+			if cfg.maxBodySize != 0 && req.ContentLength > cfg.maxBodySize {
+				outcome = requestBodyTooLarge
+				fail(http.StatusRequestEntityTooLarge, "the request body exceeds the maximum size allowed by the service")
+				logger.WithFields(log.Fields{
+					"status": http.StatusRequestEntityTooLarge,
+					"reason": http.StatusText(http.StatusRequestEntityTooLarge),
+					"host":   host,
+					"length": req.ContentLength,
+					"limit":  cfg.maxBodySize,
+				}).Error("the request body exceeds the maximum size allowed by the service")
+				return
+			}
+
+			body.max = cfg.maxBodySize
+			setWriteTimeout(w, cfg.writeTimeout)
+
+			// The time budget set by the client, capped by the service's
+			// maximum, covers all attempts and backoffs.
+			var timeout time.Duration
+			timeout, budget = clientTimeout(req.Header, s.timeout)
+
+			if max := cfg.maxRequestTimeout; max != 0 && (timeout == 0 || timeout > max) {
+				timeout = max
+			}
+
+			if timeout != 0 {
+				ctx, cancel := context.WithTimeout(req.Context(), timeout)
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
 		}
 
 		// Prepare the request to be forwarded to the service.
+		srv = cfg.order(srv)
 		address := net.JoinHostPort(srv[0].host, strconv.Itoa(srv[0].port))
-		req.URL.Scheme = "http"
+		proto := endpointProtocol(srv[0])
+		req.URL.Scheme = cfg.scheme
 		req.URL.Host = address
-		req.Header.Set("Forwarded", forwarded(req))
 
-		if res, err = http.DefaultTransport.RoundTrip(req); err == nil {
+		// HTTP/2 over TLS is negotiated during the handshake, it can only be
+		// used with https, while h2c only makes sense without TLS.
+		switch proto {
+		case protoHTTP2:
+			req.URL.Scheme = "https"
+		case protoH2C:
+			req.URL.Scheme = "http"
+		}
+
+		// Endpoints are dialed by address, their certificates are verified
+		// against the name of the service unless it's configured otherwise.
+		transport := transportFor(proto)
+
+		if req.URL.Scheme == "https" {
+			if transport, err = tlsTransportFor(proto, cfg.tls(name)); err != nil {
+				forwardFailed(err)
+				return
+			}
+		}
+
+		// Services get the remaining budget in the header the client used so
+		// they can give up when the client won't wait for the response.
+		if deadline, ok := req.Context().Deadline(); ok && len(budget) != 0 {
+			setClientTimeout(req.Header, budget, time.Until(deadline))
+		}
+
+		forwardSpan := trace.child("forward", spanClient)
+		forwardSpan.set("router.endpoint", address)
+		forwardSpan.set("router.protocol", proto)
+		forwardSpan.set("router.attempt", strconv.Itoa(attempt))
+		forwardSpan.inject(req.Header)
+
+		sent := time.Now()
+		res, err = roundTrip(transport, req, cfg)
+		upstream = time.Since(sent)
+
+		// Errors caused by the client going away are not the endpoint's fault,
+		// they're reported as such instead of transport errors.
+		if cerr := req.Context().Err(); err != nil && cerr != nil {
+			err = cerr
+		}
+
+		if err == nil {
+			forwardSpan.set("http.status_code", strconv.Itoa(res.StatusCode))
+		}
+		forwardSpan.fail(err)
+		forwardSpan.finish()
+		endpoint = address
+		attempts = attempt + 1
+		observeAttempt(service, attempt, err)
+
+		if err == nil {
 			break // success
 		}
 
-		if attempt < maxAttempts && body.n == 0 && idempotent(req.Method) {
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			abort(err)
+			return
+		}
+
+		if body.overflow() {
+			outcome = requestBodyTooLarge
+			fail(http.StatusRequestEntityTooLarge, "the request body exceeds the maximum size allowed by the service")
+			logger.WithFields(log.Fields{
+				"status": http.StatusRequestEntityTooLarge,
+				"reason": http.StatusText(http.StatusRequestEntityTooLarge),
+				"host":   host,
+				"limit":  cfg.maxBodySize,
+			}).Error("the request body exceeds the maximum size allowed by the service")
+			return
+		}
+
+		forwardErr = err
+
+		if attempt+1 < cfg.maxAttempts && body.n == 0 && idempotent(req.Method) {
 			// Adding the host to the list of black-listed addresses so it
 			// doesn't get picked up again for the next retries.
 			s.blacklist.add(address)
-			log.WithFields(log.Fields{
+			logger.WithFields(log.Fields{
 				"host":    host,
 				"address": address,
 				"error":   err,
 			}).Warn("black-listing failing service")
+			observeRetry(service, attempt)
 
-			// Backoff: 0ms, 10ms, 40ms, 90ms ... 1000ms
-			time.Sleep(time.Duration(attempt*attempt) * 10 * time.Millisecond)
+			// Backoff with the default settings: 0ms, 10ms, 40ms, 90ms ... 640ms
+			if !sleep(req.Context(), cfg.backoff(attempt)) {
+				abort(req.Context().Err())
+				return
+			}
 			continue
 		}
 
-		w.WriteHeader(http.StatusBadGateway)
-		log.WithFields(log.Fields{
-			"status": http.StatusBadGateway,
-			"reason": http.StatusText(http.StatusBadGateway),
-			"host":   host,
-			"error":  err,
-		}).Error("forwarding the request to the service returned an error")
+		forwardFailed(err)
 		return
 	}
 
@@ -169,14 +462,94 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	clearConnectionFields(hdr)
 	clearHopByHopFields(hdr)
 
+	if len(requestID) != 0 {
+		hdr.Set(s.requestID, requestID)
+	}
+
 	if s.stopped() {
 		hdr.Add("Connection", "close")
 	}
 
+	announceTrailer(hdr, res.Trailer)
+	enc := s.compression.compress(req, res, hdr)
+
 	// Send the response.
 	w.WriteHeader(res.StatusCode)
-	copyBytes(w, res.Body)
+	copySpan := trace.child("copy response", spanInternal)
+
+	var out = w
+	var ew encoderWriter
+
+	if enc != nil {
+		ew = enc.get(w)
+		out = &compressResponseWriter{ResponseWriter: w, ew: ew}
+		compressedResponses.Clone(stats.Tag{Name: "encoding", Value: enc.name}).Incr()
+	}
+
+	if !streaming(res, cfg) {
+		copyBytes(out, res.Body)
+	} else if err := copyStream(out, res.Body, cfg.flushInterval, cfg.streamIdleTimeout); err == errStreamIdle {
+		streamIdle.Clone(serviceTags(service, "", -1)...).Incr()
+		logger.WithFields(log.Fields{
+			"host":    host,
+			"address": endpoint,
+			"timeout": cfg.streamIdleTimeout,
+		}).Warn("closing idle stream")
+	}
+
+	if ew != nil {
+		ew.Close()
+		enc.put(ew)
+	}
+
 	res.Body.Close()
+	copyTrailer(hdr, res.Trailer)
+	copySpan.finish()
+}
+
+// setRequestID ensures req carries a request id in the configured header,
+// generating one if the client didn't send it or sent an invalid value, and
+// echoes it in the response. The method returns the request id, or an empty
+// string if request ids are disabled.
+func (s *httpServer) setRequestID(req *http.Request, w http.ResponseWriter) string {
+	if len(s.requestID) == 0 {
+		return ""
+	}
+
+	id := req.Header.Get(s.requestID)
+
+	if !validRequestID(id) {
+		id = newRequestID()
+		req.Header.Set(s.requestID, id)
+	}
+
+	w.Header().Set(s.requestID, id)
+	return id
+}
+
+func validRequestID(id string) bool {
+	const maxLen = 200
+
+	if len(id) == 0 || len(id) > maxLen {
+		return false
+	}
+
+	for i := 0; i != len(id); i++ {
+		if c := id[i]; c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	return newTraceID().String()
+}
+
+// inFlight returns the number of requests currently being served.
+func (s *httpServer) inFlight() int64 {
+	return atomic.LoadInt64(&s.inflight)
 }
 
 func (s *httpServer) setStopped() {
@@ -187,22 +560,199 @@ func (s *httpServer) stopped() bool {
 	return atomic.LoadUint32(&s.stop) != 0
 }
 
+// roundTrip sends req to the service using transport, applying the dial and
+// read timeouts of the service configuration.
+func roundTrip(transport http.RoundTripper, req *http.Request, cfg serviceConfig) (res *http.Response, err error) {
+	ctx, cancelCause := context.WithCancelCause(withDialTimeout(req.Context(), cfg.dialTimeout))
+	cancel := func() { cancelCause(nil) }
+
+	// The read timeout only covers the time to receive the response header,
+	// the context cannot be canceled after that or it would abort reading the
+	// response body.
+	var timer *time.Timer
+	if cfg.readTimeout != 0 {
+		timer = time.AfterFunc(cfg.readTimeout, func() { cancelCause(errUpstreamTimeout) })
+	}
+
+	res, err = transport.RoundTrip(req.WithContext(ctx))
+
+	if timer != nil {
+		timer.Stop()
+	}
+
+	if err != nil {
+		if context.Cause(ctx) == errUpstreamTimeout {
+			err = errUpstreamTimeout
+		}
+		cancel()
+		return
+	}
+
+	res.Body = &httpCancelBody{ReadCloser: res.Body, cancel: cancel}
+	return
+}
+
+// sleep waits for d to elapse, it returns false if ctx was canceled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// statusClientClosedRequest is the non-standard status code reported in logs
+// and metrics when clients close their request before getting a response.
+const statusClientClosedRequest = 499
+
+// errUpstreamTimeout is returned by roundTrip when the service didn't send the
+// response header before the read timeout.
+var errUpstreamTimeout = errors.New("timeout waiting for the service response")
+
+// setWriteTimeout overrides the write deadline that the server set on the
+// connection, it does nothing if the timeout is zero or the response writer
+// doesn't support it.
+func setWriteTimeout(w http.ResponseWriter, timeout time.Duration) {
+	if timeout != 0 {
+		responseControl("write_deadline", http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout)))
+	}
+}
+
+// responseControl counts the response controller operations that failed
+// because the response writer doesn't support them, other errors surface on
+// the next write to the response.
+func responseControl(op string, err error) {
+	if errors.Is(err, http.ErrNotSupported) {
+		unsupportedControls.Clone(stats.Tag{Name: "operation", Value: op}).Incr()
+	}
+}
+
+type responseWriterKey struct{}
+
+// instrumentHandler returns a handler serving requests with h once wrap added
+// its instrumentation.
+//
+// Wrappers measuring responses usually hide the methods of the response writer
+// that they don't need, h gets a response writer that unwraps to the one of the
+// server so the write deadline and flushes still reach the connection.
+func instrumentHandler(h http.Handler, wrap func(http.Handler) http.Handler) http.Handler {
+	inner := wrap(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if base, ok := req.Context().Value(responseWriterKey{}).(http.ResponseWriter); ok {
+			res = &instrumentedResponseWriter{ResponseWriter: res, base: base}
+		}
+		h.ServeHTTP(res, req)
+	}))
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		inner.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), responseWriterKey{}, res)))
+	})
+}
+
+// The instrumentedResponseWriter type writes the response through the writer
+// of an instrumentation wrapper and unwraps to the writer of the server.
+type instrumentedResponseWriter struct {
+	http.ResponseWriter
+	base http.ResponseWriter
+}
+
+func (w *instrumentedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.base
+}
+
+type dialTimeoutKey struct{}
+
+// withDialTimeout returns a context carrying the timeout that the dialer should
+// apply when opening connections to a service.
+func withDialTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, dialTimeoutKey{}, timeout)
+}
+
+func contextDialTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if t, ok := ctx.Value(dialTimeoutKey{}).(time.Duration); ok {
+		timeout = t
+	}
+	return timeout
+}
+
+// httpResponseWriter wraps a http.ResponseWriter to record the status code and
+// the number of bytes written in the response.
+type httpResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *httpResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *httpResponseWriter) Write(b []byte) (n int, err error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return
+}
+
+func (w *httpResponseWriter) Flush() {
+	responseControl("flush", http.NewResponseController(w.ResponseWriter).Flush())
+}
+
+// Unwrap is used by http.ResponseController to reach the underlying writer.
+func (w *httpResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 type httpBodyReader struct {
 	io.Reader
-	n int
+	n   int
+	max int64
 }
 
 func (r *httpBodyReader) Read(b []byte) (n int, err error) {
 	if n, err = r.Reader.Read(b); n > 0 {
 		r.n += n
 	}
+	if r.overflow() {
+		err = errBodyTooLarge
+	}
 	return
 }
 
+func (r *httpBodyReader) overflow() bool {
+	return r.max != 0 && int64(r.n) > r.max
+}
+
 func (r *httpBodyReader) Close() error {
 	return nil // don't close request bodies so we can do retries
 }
 
+var errBodyTooLarge = errors.New("request body too large")
+
+// httpCancelBody releases the context of a forwarded request when the response
+// body is closed.
+type httpCancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *httpCancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 func idempotent(method string) bool {
 	switch method {
 	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
@@ -244,13 +794,3 @@ func clearRequestMetadata(req *http.Request) {
 	req.Close = false
 	req.RequestURI = ""
 }
-
-func forwarded(req *http.Request) string {
-	// TODO: combine with previous Forwarded or X-Forwarded-For header.
-	return "for=" + quote(req.RemoteAddr) + ";host=" + quote(req.Host) + ";proto=http"
-}
-
-func quote(s string) string {
-	// TODO: https://tools.ietf.org/html/rfc7230#section-3.2.6
-	return strconv.QuoteToASCII(s)
-}
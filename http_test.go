@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRouter starts a router forwarding requests for name.local to the
+// backend handler, it returns the url of the router and a function to stop it.
+//
+// When backend is nil no backend is started, the router uses the resolver set
+// in config or knows no services if there's none.
+func newTestRouter(t *testing.T, name string, backend http.Handler, config httpServerConfig, options ...testOption) (string, func()) {
+	var setup testSetup
+	var b *httptest.Server
+
+	for _, option := range options {
+		option(&setup)
+	}
+
+	if backend != nil {
+		b = httptest.NewUnstartedServer(backend)
+
+		if setup.tls != nil {
+			b.EnableHTTP2 = true
+			b.StartTLS()
+			*setup.tls = b
+		} else {
+			b.Config.Protocols = testProtocols(setup.backend)
+			b.Start()
+		}
+
+		host, port, _ := net.SplitHostPort(b.Listener.Addr().String())
+		p, _ := strconv.Atoi(port)
+		config.rslv = serviceMap{name: []service{{host, p, setup.tags}}}
+
+		if setup.rslv != nil {
+			backendRslv, otherRslv := config.rslv, setup.rslv
+			config.rslv = resolverFunc(func(n string) ([]service, error) {
+				if n == name {
+					return backendRslv.resolve(n)
+				}
+				return otherRslv.resolve(n)
+			})
+		}
+	} else if config.rslv == nil {
+		config.rslv = serviceMap{}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	config.stop = stop
+	config.done = done
+	config.domain = ".local"
+
+	if config.source == nil {
+		config.source = configMap(nil)
+	}
+
+	if config.defaults == (serviceConfig{}) {
+		config.defaults = defaultServiceConfig
+	}
+
+	if config.cacheTimeout == 0 {
+		config.cacheTimeout = time.Minute
+	}
+
+	server := newHttpServer(config)
+
+	if setup.server != nil {
+		*setup.server = server
+	}
+
+	r := httptest.NewUnstartedServer(frontendHandler(server))
+	r.Config.Protocols = testProtocols(setup.frontend)
+	r.Start()
+
+	return r.URL, func() {
+		r.Close()
+		close(stop)
+		<-done
+		if b != nil {
+			b.Close()
+		}
+	}
+}
+
+// A testOption customizes the router and backend started by newTestRouter.
+type testOption func(*testSetup)
+
+type testSetup struct {
+	backend  string
+	frontend string
+	tags     []string
+	server   **httpServer
+	tls      **httptest.Server
+	rslv     resolver
+}
+
+// testProtocols returns the protocols of a test server speaking proto, the
+// defaults of http.Server if proto is empty.
+func testProtocols(proto string) *http.Protocols {
+	if len(proto) == 0 {
+		return nil
+	}
+	return protocols(proto)
+}
+
+// withBackendProtocol makes the backend speak proto, its endpoint is tagged
+// with it so the router uses it to forward requests.
+func withBackendProtocol(proto string) testOption {
+	return func(s *testSetup) {
+		s.backend = proto
+		s.tags = append(s.tags, proto)
+	}
+}
+
+// withFrontendProtocol makes the router accept connections speaking proto.
+func withFrontendProtocol(proto string) testOption {
+	return func(s *testSetup) { s.frontend = proto }
+}
+
+// withBackendTLS makes the backend speak HTTP/2 over TLS and stores it in
+// backend, its endpoint is tagged with http2.
+func withBackendTLS(backend **httptest.Server) testOption {
+	return func(s *testSetup) {
+		s.tls = backend
+		s.tags = append(s.tags, protoHTTP2)
+	}
+}
+
+// withResolver makes the router resolve the names of services other than the
+// one of the backend with rslv.
+func withResolver(rslv resolverFunc) testOption {
+	return func(s *testSetup) { s.rslv = rslv }
+}
+
+// withServer stores the http server of the router in server.
+func withServer(server **httpServer) testOption {
+	return func(s *testSetup) { s.server = server }
+}
+
+func TestRequestID(t *testing.T) {
+	received := make(chan string, 1)
+
+	url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("X-Request-Id")
+	}), httpServerConfig{requestID: "x-request-id"})
+	defer stop()
+
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"incoming", "0123456789"},
+		{"generated", ""},
+		{"invalid", "hello world"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Host = "host-1.local"
+			if len(test.id) != 0 {
+				req.Header.Set("X-Request-Id", test.id)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			id := res.Header.Get("X-Request-Id")
+			forwarded := <-received
+
+			if id != forwarded {
+				t.Errorf("the request id sent to the backend doesn't match the response: %q != %q", forwarded, id)
+			}
+
+			if validRequestID(test.id) && id != test.id {
+				t.Errorf("the incoming request id wasn't preserved: %q != %q", id, test.id)
+			}
+
+			if !validRequestID(id) {
+				t.Errorf("invalid request id: %q", id)
+			}
+		})
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+
+	backend := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		close(received)
+		<-release
+		res.Write([]byte("Hello World!"))
+	}))
+	defer backend.Close()
+
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	lstn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Handler: newHttpServer(httpServerConfig{
+			stop:         stop,
+			done:         done,
+			rslv:         serviceMap{"host-1": []service{{host, p, nil}}},
+			source:       configMap(nil),
+			domain:       ".local",
+			defaults:     defaultServiceConfig,
+			cacheTimeout: time.Minute,
+		}),
+	}
+	srv.RegisterOnShutdown(func() { close(stop) })
+	go srv.Serve(lstn)
+
+	type result struct {
+		res *http.Response
+		err error
+	}
+	results := make(chan result, 1)
+
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+lstn.Addr().String(), nil)
+		req.Host = "host-1.local"
+		res, err := http.DefaultClient.Do(req)
+		results <- result{res, err}
+	}()
+
+	<-received
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	// Give the server some time to start shutting down before the in-flight
+	// request completes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal("the in-flight request was dropped:", r.err)
+	}
+	r.res.Body.Close()
+
+	if r.res.StatusCode != http.StatusOK {
+		t.Error("bad status code:", r.res.StatusCode)
+	}
+
+	if !r.res.Close {
+		t.Error("the response didn't ask the client to close the connection")
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Error("shutdown failed:", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the router didn't report that it was done serving requests")
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}), httpServerConfig{})
+	defer stop()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = "host-2.local"
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Error("bad status:", res.StatusCode)
+	}
+}
+
+func TestEndpointsExhausted(t *testing.T) {
+	// The only endpoint of the service refuses connections, retrying
+	// black-lists it and must not turn the error into a 503.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	url, stop := newTestRouter(t, "host-1", nil, httpServerConfig{
+		rslv: serviceMap{"host-1": []service{{host, p, nil}}},
+	})
+	defer stop()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = "host-1.local"
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadGateway {
+		t.Error("bad status:", res.StatusCode)
+	}
+}
+
+func TestClientAbort(t *testing.T) {
+	var requests int32
+	canceled := make(chan struct{}, 10)
+
+	url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-req.Context().Done()
+		canceled <- struct{}{}
+	}), httpServerConfig{})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = "host-1.local"
+
+	if _, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("the request should have been aborted")
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the request to the service wasn't canceled")
+	}
+
+	// Give the router a chance to retry if it didn't notice the client was
+	// gone.
+	time.Sleep(50 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Error("the request was retried:", n)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if !sleep(context.Background(), time.Millisecond) {
+		t.Error("sleep returned false on a live context")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+
+	if sleep(ctx, time.Minute) {
+		t.Error("sleep returned true on a canceled context")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Error("sleep didn't return when the context was canceled")
+	}
+}
+
+// opaqueResponseWriter hides the methods of the response writer it wraps like
+// instrumentation wrappers do.
+type opaqueResponseWriter struct {
+	w http.ResponseWriter
+}
+
+func (w opaqueResponseWriter) Header() http.Header         { return w.w.Header() }
+func (w opaqueResponseWriter) Write(b []byte) (int, error) { return w.w.Write(b) }
+func (w opaqueResponseWriter) WriteHeader(status int)      { w.w.WriteHeader(status) }
+
+func TestInstrumentHandler(t *testing.T) {
+	opaque := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			h.ServeHTTP(opaqueResponseWriter{res}, req)
+		})
+	}
+
+	tests := []struct {
+		name    string
+		handler func(http.Handler) http.Handler
+		err     error
+	}{
+		{
+			name:    "wrapped",
+			handler: opaque,
+			err:     http.ErrNotSupported,
+		},
+		{
+			name:    "instrumented",
+			handler: func(h http.Handler) http.Handler { return instrumentHandler(h, opaque) },
+		},
+		{
+			name:    "frontend",
+			handler: frontendHandler,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var deadlineErr, flushErr error
+
+			server := httptest.NewServer(test.handler(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				rc := http.NewResponseController(res)
+				deadlineErr = rc.SetWriteDeadline(time.Now().Add(time.Second))
+				flushErr = rc.Flush()
+			})))
+			defer server.Close()
+
+			res, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if !errors.Is(deadlineErr, test.err) {
+				t.Error("bad write deadline error:", deadlineErr)
+			}
+			if !errors.Is(flushErr, test.err) {
+				t.Error("bad flush error:", flushErr)
+			}
+		})
+	}
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
-	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -45,36 +46,140 @@ func main() {
 		BindHTTP        string `conf:"bind-http" help:"The network address on which the router will listen for incoming connections"`
 		BindHealthCheck string `conf:"bind-health-check" help:"The network address on which the router listens for health checks"`
 		BindPProf       string `conf:"bind-pprof" help:"The network address on which router listens for profiling requests"`
+		BindAdmin       string `conf:"bind-admin" help:"The network address on which the router listens for admin api requests"`
+		BindMetrics     string `conf:"bind-metrics" help:"The network address on which the router exposes metrics in the prometheus format"`
 		Consul          string `conf:"consul" help:"The address at which the router can access a consul agent"`
 		Datadog         string `conf:"datadog" help:"The address at which the router will send datadog metrics"`
 		Domain          string `conf:"domain" help:"The domain for which the router will accept requests"`
 		Prefer          string `conf:"prefer" help:"The services with a tag matching the preferred value will be favored by the router"`
+		Balance         string `conf:"balance" help:"The load balancing strategy used to pick a service endpoint (first, random)"`
+		Scheme          string `conf:"scheme" help:"The scheme used to forward requests to the services (http, https)"`
+		ConfigPrefix    string `conf:"config-prefix" help:"The consul KV prefix under which per-service settings are stored"`
+		RequestTimeout  string `conf:"request-timeout-header" help:"The header carrying the time budget of requests, grpc-timeout is always honored, empty disables the header"`
+		RequestID       string `conf:"request-id" help:"The header carrying request ids, generated when missing and echoed in responses, empty disables request ids"`
+		TrustedProxies  string `conf:"trusted-proxies" help:"Comma separated list of networks from which Forwarded and X-Forwarded-* headers are trusted"`
+		Register        string `conf:"register" help:"The service name under which the router registers itself in consul, registration is disabled when empty"`
+		RegisterTags    string `conf:"register-tags" help:"Comma separated list of tags set on the router's consul registration"`
+		RegisterAddress string `conf:"register-address" help:"The address advertised in the router's consul registration, the consul agent's address is used when empty"`
+		ErrorPages      string `conf:"error-pages" help:"The directory holding html templates of error pages, named <status>.html or default.html"`
+		Instance        string `conf:"instance" help:"The name of the router instance reported in error responses, defaults to the hostname"`
+		InstanceHeader  string `conf:"instance-header" help:"The response header naming the router instance that generated an error, empty disables the header"`
+		CompressTypes   string `conf:"compress-types" help:"Comma separated list of media types compressed by the router, like text/* or application/json, a built-in list is used when empty"`
+		ProxySources    string `conf:"proxy-protocol-sources" help:"Comma separated list of networks allowed to send PROXY protocol headers, required when proxy-protocol is set"`
+
+		AccessLog           string  `conf:"access-log" help:"Where access logs are written (stderr, file, syslog), access logs are disabled when empty"`
+		AccessLogFormat     string  `conf:"access-log-format" help:"The format of access logs (json, logfmt, common, combined)"`
+		AccessLogSample     float64 `conf:"access-log-sample" help:"The fraction of requests written to the access log, 5xx responses are always logged"`
+		AccessLogFile       string  `conf:"access-log-file" help:"The path to the access log file when access-log is set to file"`
+		AccessLogMaxSize    int     `conf:"access-log-max-size" help:"The size in bytes at which the access log file is rotated, zero disables rotation"`
+		AccessLogMaxBackups int     `conf:"access-log-max-backups" help:"The number of rotated access log files that are kept"`
+		AccessLogSyslog     string  `conf:"access-log-syslog" help:"The address of the syslog server as network://host:port, the local syslog daemon is used when empty"`
+
+		TraceExporter  string  `conf:"trace-exporter" help:"The protocol used to export traces (otlp, zipkin)"`
+		TraceCollector string  `conf:"trace-collector" help:"The URL to which spans are sent, tracing is disabled when empty"`
+		TraceSample    float64 `conf:"trace-sample" help:"The fraction of new traces that are sampled, incoming sampling decisions are always honored"`
+		TraceService   string  `conf:"trace-service" help:"The service name reported in the spans generated by the router"`
 
 		CacheTimeout    time.Duration `conf:"cache-timeout" help:"The timeout for cached hostnames"`
+		CacheMaxStale   time.Duration `conf:"cache-max-stale" help:"How long cached hostnames are served past their expiration while being refreshed or when consul is unavailable"`
+		CacheNegative   time.Duration `conf:"cache-negative-timeout" help:"The timeout for cached hostnames that didn't resolve to any endpoint"`
+		ConsulTimeout   time.Duration `conf:"consul-timeout" help:"The timeout for requests sent to the consul agent"`
 		DialTimeout     time.Duration `conf:"dial-timeout" help:"The timeout for dialing tcp connections"`
 		ReadTimeout     time.Duration `conf:"read-timeout" help:"The timeout for reading http requests"`
 		WriteTimeout    time.Duration `conf:"write-timeout" help:"The timeout for writing http requests"`
 		IdleTimeout     time.Duration `conf:"idle-timeout" help:"The timeout for idle connections"`
 		ShutdownTimeout time.Duration `conf:"shutdown-timeout" help:"The timeout for shutting down the router"`
+		UpgradeTimeout  time.Duration `conf:"upgrade-timeout" help:"How long the router waits for the process it hands off its listeners to on SIGUSR2 to start serving"`
+		PreStopDelay    time.Duration `conf:"pre-stop-delay" help:"The delay during which the router keeps serving traffic after failing health checks on shutdown"`
+		HealthWindow    time.Duration `conf:"health-window" help:"The amount of time after which the router stops being ready when the consul agent doesn't answer"`
+		UnknownInterval time.Duration `conf:"unknown-interval" help:"The interval over which unknown hostnames are counted"`
+		CheckInterval   time.Duration `conf:"check-interval" help:"The interval at which consul checks the health of the router when it registers itself"`
+		RetryBackoff    time.Duration `conf:"retry-backoff" help:"The base delay between attempts to forward a request, grows quadratically with the number of attempts"`
+		MaxRequest      time.Duration `conf:"max-request-timeout" help:"The maximum time budget of requests across all attempts, zero means no limit"`
+		FlushInterval   time.Duration `conf:"flush-interval" help:"The interval at which streamed responses are flushed to clients, zero flushes after each write"`
+		StreamIdle      time.Duration `conf:"stream-idle-timeout" help:"The timeout after which streamed responses are closed when services don't send data, replaces the write timeout for streams"`
 
+		UnknownLimit        int  `conf:"unknown-limit" help:"The maximum number of distinct unknown hostnames queried in consul per interval, zero means no limit"`
+		KnownServices       bool `conf:"known-services" help:"When set the router rejects hostnames that are not in the consul catalog without querying their endpoints"`
+		CacheSize           int  `conf:"cache-size" help:"The maximum number of hostnames kept in the cache, zero means no limit"`
 		MaxIdleConns        int  `conf:"max-idle-conns" help:"The maximum number of idle connections kept"`
 		MaxIdleConnsPerHost int  `conf:"max-idle-conns-per-host" help:"The maximum number of idle connections kept per host"`
 		MaxHeaderBytes      int  `conf:"max-header-bytes" help:"The maximum number of bytes allowed in http headers"`
+		MaxAttempts         int  `conf:"max-attempts" help:"The maximum number of attempts at forwarding a request, including the first one"`
+		MaxBodySize         int  `conf:"max-body-size" help:"The maximum number of bytes allowed in request bodies, zero means no limit"`
+		H2C                 bool `conf:"h2c" help:"When set the http server accepts cleartext HTTP/2 connections with prior knowledge, which gRPC clients use"`
 		EnableCompression   bool `conf:"enable-compression" help:"When set the router will ask for compressed payloads"`
+		CompressResponses   bool `conf:"compress-responses" help:"When set the router compresses responses with brotli, zstd or gzip for clients that accept it"`
+		CompressLevel       int  `conf:"compress-level" help:"The gzip compression level of responses, from 1 (fastest) to 9 (smallest), -1 for the default"`
+		CompressMinSize     int  `conf:"compress-min-size" help:"The minimum size in bytes of compressed responses"`
+		ProxyProtocol       bool `conf:"proxy-protocol" help:"When set the router expects connections to start with a PROXY protocol header"`
 	}{
+		Balance:             balanceFirst,
+		Scheme:              "http",
+		ConfigPrefix:        "consul-router/services",
+		RequestID:           "X-Request-Id",
+		RequestTimeout:      "X-Request-Timeout",
+		InstanceHeader:      "X-Router-Instance",
+		AccessLogFormat:     "json",
+		AccessLogSample:     1,
+		AccessLogMaxSize:    100 * 1024 * 1024,
+		AccessLogMaxBackups: 5,
+		TraceExporter:       "otlp",
+		TraceSample:         1,
+		TraceService:        "consul-router",
 		CacheTimeout:        10 * time.Second,
+		CacheMaxStale:       1 * time.Minute,
+		CacheNegative:       2 * time.Second,
 		DialTimeout:         10 * time.Second,
+		ConsulTimeout:       5 * time.Second,
 		ReadTimeout:         30 * time.Second,
 		WriteTimeout:        30 * time.Second,
 		IdleTimeout:         90 * time.Second,
 		ShutdownTimeout:     10 * time.Second,
+		UpgradeTimeout:      30 * time.Second,
+		HealthWindow:        30 * time.Second,
+		CheckInterval:       10 * time.Second,
+		RetryBackoff:        10 * time.Millisecond,
+		StreamIdle:          5 * time.Minute,
+		CacheSize:           10000,
+		UnknownLimit:        100,
+		UnknownInterval:     10 * time.Second,
 		MaxIdleConns:        10000,
 		MaxIdleConnsPerHost: 100,
 		MaxHeaderBytes:      65536,
+		MaxAttempts:         10,
+		CompressLevel:       -1,
+		CompressMinSize:     1024,
 	}
 
 	conf.Load(&config)
 
+	// SIGUSR2 terminates the process by default, it's caught before opening
+	// any listener so an upgrade requested while the program starts doesn't
+	// kill it, the signal is handled once the program serves.
+	upgchan := make(chan os.Signal, 1)
+	signal.Notify(upgchan, syscall.SIGUSR2)
+
+	// The listening sockets passed by the process that this one replaces, and
+	// the listeners opened by the program so they can be passed on in turn.
+	inherited, err := inheritedListeners()
+	if err != nil {
+		log.WithError(err).Fatal("failed to load inherited listeners")
+	}
+
+	listeners := map[string]net.Listener{}
+	serve := func(name string, address string, handler http.Handler) {
+		lstn, err := listen(name, address, inherited)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"address": address,
+				"error":   err,
+			}).Fatal("failed to bind tcp address")
+		}
+		listeners[name] = lstn
+		go http.Serve(lstn, handler)
+	}
+
 	// The datadog client that reports metrics generated by the router.
 	if len(config.Datadog) != 0 {
 		dd := datadog.NewClient(datadog.ClientConfig{
@@ -83,20 +188,177 @@ func main() {
 		defer dd.Close()
 		log.WithField("address", config.Datadog).Info("using datadog agent for metrics collection")
 	}
+
+	// The prometheus handler aggregates metrics generated by the router so they
+	// can be scraped.
+	if len(config.BindMetrics) != 0 {
+		prom := newPrometheusHandler()
+		stats.Register(prom)
+		serve("bind-metrics", config.BindMetrics, prom)
+		log.WithField("address", config.BindMetrics).Info("started prometheus metrics server")
+	}
+
 	defer procstats.StartCollector(procstats.NewGoMetrics(nil)).Close()
 	defer procstats.StartCollector(procstats.NewProcMetrics(nil)).Close()
 
-	// Configure the base resolver used by the router to forward requests.
+	// Configure the base resolver used by the router to forward requests, and
+	// the source of per-service settings.
 	var rslv resolver
+	var source configSource
 	switch {
 	case len(config.Consul) != 0:
+		consulClient.Timeout = config.ConsulTimeout
 		rslv = consulResolver{address: config.Consul}
+		source = consulConfig{address: config.Consul, prefix: config.ConfigPrefix}
 		log.WithField("address", config.Consul).Info("using consul agent for service discovery")
+
+		// Protect the consul agent from queries for services that don't
+		// exist, optionally using the catalog of registered services.
+		filter := unknownFilterConfig{
+			limit:    config.UnknownLimit,
+			interval: config.UnknownInterval,
+			refresh:  config.CacheTimeout,
+		}
+
+		if config.KnownServices {
+			filter.catalog = consulCatalog{address: config.Consul}
+			log.Info("rejecting services that are not registered in the consul catalog")
+		}
+
+		rslv = filterUnknown(filter, rslv)
 	default:
 		rslv = serviceList(nil)
+		source = configMap(nil)
 		log.Warn("no service discovery backend was configured")
 	}
 
+	// The default settings applied to services that don't override them.
+	defaults := serviceConfig{
+		dialTimeout:  config.DialTimeout,
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+		maxAttempts:  config.MaxAttempts,
+		retryBackoff: config.RetryBackoff,
+		prefer:       config.Prefer,
+		maxBodySize:  int64(config.MaxBodySize),
+
+		maxRequestTimeout: config.MaxRequest,
+		flushInterval:     config.FlushInterval,
+		streamIdleTimeout: config.StreamIdle,
+	}
+
+	if err := defaults.set("balance", config.Balance); err != nil {
+		log.WithError(err).Fatal("invalid load balancing strategy")
+	}
+
+	if err := defaults.set("scheme", config.Scheme); err != nil {
+		log.WithError(err).Fatal("invalid backend scheme")
+	}
+
+	// Configure the access log, requests are not logged unless a sink is set.
+	var accessLog *accessLogger
+
+	if len(config.AccessLog) != 0 {
+		var err error
+
+		if accessLog, err = newAccessLogger(accessLoggerConfig{
+			sink:       config.AccessLog,
+			format:     config.AccessLogFormat,
+			sample:     config.AccessLogSample,
+			file:       config.AccessLogFile,
+			maxSize:    int64(config.AccessLogMaxSize),
+			maxBackups: config.AccessLogMaxBackups,
+			syslog:     config.AccessLogSyslog,
+		}); err != nil {
+			log.WithError(err).Fatal("failed to configure the access log")
+		}
+
+		log.WithFields(log.Fields{
+			"sink":   config.AccessLog,
+			"format": config.AccessLogFormat,
+		}).Info("writing access logs")
+	}
+
+	// Configure distributed tracing, the router propagates the trace context
+	// and reports spans only if a collector was set.
+	var trc *tracer
+
+	if len(config.TraceCollector) != 0 {
+		exporter, err := newSpanExporter(config.TraceExporter, config.TraceCollector, config.TraceService)
+
+		if err != nil {
+			log.WithError(err).Fatal("failed to configure tracing")
+		}
+
+		trc = newTracer(tracerConfig{
+			exporter:      exporter,
+			sample:        config.TraceSample,
+			batchSize:     512,
+			flushInterval: 1 * time.Second,
+		})
+		defer trc.close()
+
+		log.WithFields(log.Fields{
+			"exporter":  config.TraceExporter,
+			"collector": config.TraceCollector,
+		}).Info("exporting traces")
+	}
+
+	// The list of proxies from which forwarding headers are accepted, and of
+	// load balancers allowed to send PROXY protocol headers.
+	trusted, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.WithError(err).Fatal("invalid list of trusted proxies")
+	}
+
+	proxySources, err := parseTrustedProxies(config.ProxySources)
+	if err != nil {
+		log.WithError(err).Fatal("invalid list of PROXY protocol sources")
+	}
+
+	// Trusting PROXY protocol headers from anyone would let clients spoof
+	// their address, the sources must be listed explicitly.
+	if config.ProxyProtocol && len(proxySources) == 0 {
+		log.Fatal("proxy-protocol requires a list of trusted sources in proxy-protocol-sources")
+	}
+
+	// The pages rendered when the router fails to serve a request, errors
+	// carry the name of the router instance that generated them.
+	instance := config.Instance
+	if len(instance) == 0 {
+		instance, _ = os.Hostname()
+	}
+
+	errorPages, err := loadErrorPages(errorPagesConfig{
+		dir:      config.ErrorPages,
+		instance: instance,
+		header:   config.InstanceHeader,
+	})
+	if err != nil {
+		log.WithError(err).Fatal("failed to load the error pages")
+	}
+
+	// Compression of responses for clients that accept compressed payloads.
+	var compress *compression
+
+	if config.CompressResponses {
+		var types []string
+
+		for _, t := range strings.Split(config.CompressTypes, ",") {
+			if t = strings.TrimSpace(t); len(t) != 0 {
+				types = append(types, strings.ToLower(t))
+			}
+		}
+
+		if compress, err = newCompression(compressionConfig{
+			level:   config.CompressLevel,
+			minSize: int64(config.CompressMinSize),
+			types:   types,
+		}); err != nil {
+			log.WithError(err).Fatal("invalid response compression settings")
+		}
+	}
+
 	// The domain name served by the router, prefix with '.' so it doesn't have
 	// to be done over and over in each http request.
 	domain := config.Domain
@@ -104,66 +366,95 @@ func main() {
 		domain = "." + domain
 	}
 
-	// Start the health check server, the status variable is used to report when
-	// the program is shutting down.
-	healthStatus := uint32(http.StatusOK)
-	if len(config.BindHealthCheck) != 0 {
-		go http.ListenAndServe(config.BindHealthCheck, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-			res.WriteHeader(int(atomic.LoadUint32(&healthStatus)))
-		}))
-		log.WithField("address", config.BindHealthCheck).Info("started health check server")
-	}
-
 	// Start hte profiler server.
 	if len(config.BindPProf) != 0 {
-		go http.ListenAndServe(config.BindPProf, nil)
+		serve("bind-pprof", config.BindPProf, http.DefaultServeMux)
 		log.WithField("address", config.BindPProf).Info("started profiling server")
 	}
 
-	// Configure the default http transport which is used for forwarding the requests.
-	http.DefaultTransport = httpstats.NewTransport(nil, &http.Transport{
-		DialContext:            dialer(config.DialTimeout),
-		IdleConnTimeout:        config.IdleTimeout,
-		MaxIdleConns:           config.MaxIdleConns,
-		MaxIdleConnsPerHost:    config.MaxIdleConnsPerHost,
-		ResponseHeaderTimeout:  config.ReadTimeout,
-		ExpectContinueTimeout:  config.ReadTimeout,
-		MaxResponseHeaderBytes: int64(config.MaxHeaderBytes),
-		DisableCompression:     !config.EnableCompression,
-	})
+	// Configure the http transports which are used for forwarding the requests,
+	// the default transport speaks HTTP/1.1 and endpoints tagged with h2c or
+	// http2 get their own HTTP/2 transport, services reached over TLS get
+	// transports verifying their certificates. The response header timeout is
+	// not set here because it is applied on each request from the service
+	// configuration. The default transport is left alone, it's used by the
+	// clients of consul and of the trace collector which have timeouts of
+	// their own.
+	newTransport = func(proto string, tlsConfig *tls.Config) http.RoundTripper {
+		return httpstats.NewTransport(nil, &http.Transport{
+			DialContext:            dialer(config.DialTimeout),
+			IdleConnTimeout:        config.IdleTimeout,
+			MaxIdleConns:           config.MaxIdleConns,
+			MaxIdleConnsPerHost:    config.MaxIdleConnsPerHost,
+			ExpectContinueTimeout:  config.ReadTimeout,
+			MaxResponseHeaderBytes: int64(config.MaxHeaderBytes),
+			DisableCompression:     !config.EnableCompression,
+			Protocols:              protocols(proto),
+			TLSClientConfig:        tlsConfig,
+		})
+	}
+
+	transports[protoHTTP1] = newTransport(protoHTTP1, nil)
+	transports[protoH2C] = newTransport(protoH2C, nil)
+	transports[protoHTTP2] = newTransport(protoHTTP2, nil)
 
 	// Configure and run the http server.
 	var httpLstn net.Listener
+	var httpFront *http.Server
+	var httpSrv *httpServer
 	var httpStop chan struct{}
 	var httpDone chan struct{}
-	var err error
 
 	if len(config.BindHTTP) != 0 {
-		if httpLstn, err = net.Listen("tcp", config.BindHTTP); err != nil {
+		if httpLstn, err = listen("bind-http", config.BindHTTP, inherited); err != nil {
 			log.WithFields(log.Fields{
 				"address": config.BindHTTP,
 				"error":   err,
 			}).Fatal("failed to bind tcp address for http server")
 		}
 
+		listeners["bind-http"] = httpLstn
+
+		if config.ProxyProtocol {
+			httpLstn = newProxyListener(httpLstn, config.ReadTimeout, proxySources)
+			log.WithField("sources", config.ProxySources).Info("expecting PROXY protocol headers on the http server")
+		}
+
 		httpLstn = netstats.NewListener(nil, httpLstn, stats.Tag{"side", "frontend"})
 		httpStop = make(chan struct{})
 		httpDone = make(chan struct{})
+		httpSrv = newHttpServer(httpServerConfig{
+			stop:                 httpStop,
+			done:                 httpDone,
+			rslv:                 rslv,
+			source:               source,
+			accessLog:            accessLog,
+			tracer:               trc,
+			requestID:            config.RequestID,
+			timeoutHeader:        config.RequestTimeout,
+			trusted:              trusted,
+			errorPages:           errorPages,
+			compression:          compress,
+			domain:               domain,
+			defaults:             defaults,
+			cacheTimeout:         config.CacheTimeout,
+			cacheMaxStale:        config.CacheMaxStale,
+			cacheNegativeTimeout: config.CacheNegative,
+			cacheSize:            config.CacheSize,
+		})
+
+		httpFront = &http.Server{
+			Protocols:      frontendProtocols(config.H2C),
+			ReadTimeout:    config.ReadTimeout,
+			WriteTimeout:   config.WriteTimeout,
+			IdleTimeout:    config.IdleTimeout,
+			MaxHeaderBytes: config.MaxHeaderBytes,
+			Handler:        frontendHandler(httpSrv),
+		}
+		httpFront.RegisterOnShutdown(func() { close(httpStop) })
 
 		go func() {
-			if err := (&http.Server{
-				ReadTimeout:    config.ReadTimeout,
-				WriteTimeout:   config.WriteTimeout,
-				MaxHeaderBytes: config.MaxHeaderBytes,
-				Handler: httpstats.NewHandler(nil, newHttpServer(httpServerConfig{
-					stop:         httpStop,
-					done:         httpDone,
-					rslv:         rslv,
-					domain:       domain,
-					prefer:       config.Prefer,
-					cacheTimeout: config.CacheTimeout,
-				})),
-			}).Serve(httpLstn); err != nil && atomic.LoadUint32(&healthStatus) == http.StatusOK {
+			if err := httpFront.Serve(httpLstn); err != nil && err != http.ErrServerClosed {
 				log.WithError(err).Fatal("failed to serve http requests")
 			}
 		}()
@@ -171,39 +462,240 @@ func main() {
 		log.WithField("address", config.BindHTTP).Info("started http server")
 	}
 
+	// Start the admin server, it exposes the internal state of the http server
+	// so there's nothing to serve if it wasn't started.
+	if len(config.BindAdmin) != 0 {
+		if httpSrv != nil {
+			serve("bind-admin", config.BindAdmin, newAdminServer(httpSrv))
+			log.WithField("address", config.BindAdmin).Info("started admin server")
+		} else {
+			log.Warn("not starting the admin server because the http server is disabled")
+		}
+	}
+
+	// Start the health check server, it reports the router as draining when
+	// the program is shutting down.
+	if config.HealthWindow < minHealthWindow {
+		log.WithField("window", config.HealthWindow).Fatal("health-window must be at least 1s")
+	}
+
+	health := newHealthServer(healthServerConfig{
+		server: httpSrv,
+		consul: config.Consul,
+		window: config.HealthWindow,
+	})
+	defer health.close()
+
+	if len(config.BindHealthCheck) != 0 {
+		serve("bind-health-check", config.BindHealthCheck, health)
+		log.WithField("address", config.BindHealthCheck).Info("started health check server")
+	}
+
+	// Register the router in consul, this requires knowing the port on which
+	// the http server accepts connections.
+	var reg *consulRegistration
+	var regStop chan struct{}
+	var regDone chan struct{}
+
+	if len(config.Register) != 0 {
+		switch {
+		case len(config.Consul) == 0:
+			log.Warn("not registering the router because no consul agent was configured")
+		case httpLstn == nil:
+			log.Warn("not registering the router because the http server is disabled")
+		default:
+			hostname, _ := os.Hostname()
+			_, port, _ := net.SplitHostPort(listeners["bind-http"].Addr().String())
+			p, _ := strconv.Atoi(port)
+
+			reg = &consulRegistration{
+				address:  config.Consul,
+				id:       config.Register + "-" + hostname + "-" + port,
+				name:     config.Register,
+				host:     config.RegisterAddress,
+				port:     p,
+				interval: config.CheckInterval,
+			}
+
+			for _, tag := range strings.Split(config.RegisterTags, ",") {
+				if tag = strings.TrimSpace(tag); len(tag) != 0 {
+					reg.tags = append(reg.tags, tag)
+				}
+			}
+
+			if lstn := listeners["bind-health-check"]; lstn != nil {
+				reg.check = localURL(lstn.Addr(), "/health/ready")
+			}
+
+			// The router serves traffic even if the consul agent is not
+			// reachable yet, registering is retried in the background.
+			regStop = make(chan struct{})
+			regDone = make(chan struct{})
+
+			go func(reg *consulRegistration) {
+				defer close(regDone)
+
+				if err := reg.keepRegistering(regStop, time.Second, time.Minute); err == nil {
+					log.WithFields(log.Fields{
+						"id":   reg.id,
+						"name": reg.name,
+						"tags": config.RegisterTags,
+					}).Info("registered the router in consul")
+				}
+			}(reg)
+		}
+	}
+
+	// When started by a process handing off its listeners, tell it that this
+	// one is now serving so it can shut down.
+	if err := notifyReady(); err != nil {
+		log.WithError(err).Error("failed to report that the router is serving")
+	}
+
 	// Gracefully shutdown when receiving a signal:
-	// - set the health check status to 503
-	// - close tcp connections
-	// - wait for in-flight requests to complete
+	// - deregister the router from consul
+	// - report the router as draining in health checks
+	// - keep serving traffic while load balancers deregister the router
+	// - close the listener and idle connections
+	// - wait for in-flight requests and streams to complete
+	// A second signal skips the remaining steps.
+	//
+	// On SIGUSR2 the listeners are first passed to a new instance of the
+	// program, the health check keeps succeeding and the consul registration
+	// is kept since the new process now serves traffic on the same sockets.
 	sigchan := make(chan os.Signal)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
 
-	sig := <-sigchan
-	log.WithField("signal", sig).Info("shutting down")
-	atomic.StoreUint32(&healthStatus, http.StatusServiceUnavailable)
+	for upgchan != nil {
+		select {
+		case sig := <-sigchan:
+			log.WithField("signal", sig).Info("shutting down")
+
+			if reg != nil {
+				// Stopping the retries first guarantees that the router is
+				// not registered again after being deregistered.
+				close(regStop)
+				<-regDone
+
+				if err := reg.deregister(); err != nil {
+					log.WithError(err).Error("failed to deregister the router from consul")
+				}
+			}
+
+			health.setDraining()
 
-	if httpLstn != nil {
-		httpLstn.Close()
-		close(httpStop)
+			if config.PreStopDelay != 0 {
+				log.WithField("delay", config.PreStopDelay).Info("waiting for load balancers to stop sending traffic")
+				select {
+				case <-time.After(config.PreStopDelay):
+				case <-sigchan:
+					return
+				}
+			}
+
+			upgchan = nil
+
+		case <-upgchan:
+			proc, err := handoff(listeners, config.UpgradeTimeout)
+			if err != nil {
+				log.WithError(err).Error("failed to hand off listeners to a new process, keeping on serving")
+				continue
+			}
+
+			log.WithField("pid", proc.Pid).Info("handed off listeners to a new process, shutting down")
+			signal.Stop(upgchan)
+			proc.Release()
+
+			// The http listener is closed by the shutdown sequence, the other
+			// ones are closed right away so only the new process accepts
+			// connections on them.
+			for name, lstn := range listeners {
+				if name != "bind-http" {
+					lstn.Close()
+				}
+			}
+
+			upgchan = nil
+		}
 	}
 
-	for httpDone != nil {
-		select {
-		case <-time.After(config.ShutdownTimeout):
-			return
-		case <-sigchan:
+	if httpFront != nil {
+		if !shutdown(httpFront, config.ShutdownTimeout, sigchan) {
 			return
+		}
+
+		// After a forced close the handlers see their connections fail and
+		// return shortly after, wait for them so access logs and traces of
+		// the last requests are flushed.
+		select {
 		case <-httpDone:
-			httpDone = nil
+		case <-time.After(time.Second):
+		case <-sigchan:
 		}
 	}
 }
 
-func dialer(timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
-	dialer := &net.Dialer{
-		Timeout: timeout,
+// shutdown gracefully shuts down srv, waiting up to timeout for active
+// connections to become idle. Connections that are still active when the
+// timeout expires, like long-lived streams, are closed. The function returns
+// false if the shutdown was interrupted by a signal.
+func shutdown(srv *http.Server, timeout time.Duration, sigchan <-chan os.Signal) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errchan := make(chan error, 1)
+	go func() { errchan <- srv.Shutdown(ctx) }()
+
+	select {
+	case err := <-errchan:
+		if err != nil {
+			log.WithError(err).Warn("closing connections that did not drain before the shutdown timeout")
+			srv.Close()
+		}
+		return true
+	case <-sigchan:
+		srv.Close()
+		return false
 	}
+}
+
+// frontendProtocols returns the protocols accepted by the http server, HTTP/2
+// is always negotiated on TLS connections.
+func frontendProtocols(h2c bool) *http.Protocols {
+	p := &http.Protocols{}
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(h2c)
+	return p
+}
+
+// frontendHandler returns the handler of the http server, it measures the
+// requests handled by h.
+func frontendHandler(h http.Handler) http.Handler {
+	return instrumentHandler(h, func(h http.Handler) http.Handler {
+		return httpstats.NewHandler(nil, h)
+	})
+}
+
+// localURL returns the url at which a local process can reach path on the
+// server listening on addr.
+func localURL(addr net.Addr, path string) string {
+	host, port, _ := net.SplitHostPort(addr.String())
+
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	return "http://" + net.JoinHostPort(host, port) + path
+}
+
+func dialer(timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
 	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		// The timeout may be overridden by the configuration of the service
+		// that the connection is opened for.
+		dialer := &net.Dialer{
+			Timeout: contextDialTimeout(ctx, timeout),
+		}
 		conn, err := dialer.DialContext(ctx, network, address)
 		if conn != nil {
 			conn = netstats.NewConn(nil, conn, stats.Tag{"side", "backend"})
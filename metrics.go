@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// Metrics reported by the router, they are published through the default
+// stats engine so they reach every configured backend (datadog, prometheus).
+//
+// Tagging by service name is only done once a name is known to resolve, this
+// way clients sending requests for random hostnames can't create new series.
+var (
+	// Time spent querying the service discovery backend, tagged by outcome.
+	resolveTimer = stats.NewTimer("router.resolve.time")
+
+	// Lookups in the resolver cache, tagged by outcome (hit, miss, expired,
+	// revalidated when an expired entry was served while being refreshed).
+	cacheHits        = stats.NewCounter("router.cache.lookups", stats.Tag{Name: "outcome", Value: "hit"})
+	cacheMisses      = stats.NewCounter("router.cache.lookups", stats.Tag{Name: "outcome", Value: "miss"})
+	cacheExpired     = stats.NewCounter("router.cache.lookups", stats.Tag{Name: "outcome", Value: "expired"})
+	cacheRevalidated = stats.NewCounter("router.cache.lookups", stats.Tag{Name: "outcome", Value: "revalidated"})
+
+	// Background refreshes of cache entries tagged by service name and
+	// outcome, and number of times the cache kept serving stale endpoints
+	// because refreshing a service failed, tagged by service name.
+	cacheRefreshes = stats.NewCounter("router.cache.refreshes")
+	cacheStale     = stats.NewCounter("router.cache.stale")
+
+	// Entries evicted from the resolver cache because it was full, tagged by
+	// the LRU segment they were evicted from (probation, protected).
+	cacheEvictions = stats.NewCounter("router.cache.evictions")
+
+	// Attempts at forwarding requests to services, tagged by service name,
+	// attempt number and outcome.
+	attemptCounter = stats.NewCounter("router.attempts")
+
+	// Number of times a request was retried after failing to be forwarded,
+	// tagged by service name and attempt number.
+	retryCounter = stats.NewCounter("router.retries")
+
+	// Number of addresses currently in the blacklist, the number of endpoints
+	// that were black-listed after a failure and the number of endpoints that
+	// were filtered out of resolver responses.
+	blacklistGauge    = stats.NewGauge("router.blacklist.size")
+	ejectionCounter   = stats.NewCounter("router.blacklist.ejections")
+	blacklistFiltered = stats.NewCounter("router.blacklist.filtered")
+
+	// Names rejected without querying the service discovery backend, tagged
+	// by outcome (catalog when the name isn't registered, limit when too many
+	// unknown names were queried).
+	unknownRejected = stats.NewCounter("router.unknown.rejected")
+
+	// Connections rejected because they came from an untrusted source or had
+	// an invalid PROXY protocol header.
+	proxyRejected = stats.NewCounter("router.proxy.rejected")
+
+	// Streamed responses aborted because the service didn't send data for the
+	// stream idle timeout, tagged by service name.
+	streamIdle = stats.NewCounter("router.stream.idle_timeouts")
+
+	// Response controller operations (flush, write_deadline) that failed
+	// because the response writer doesn't support them, tagged by operation.
+	unsupportedControls = stats.NewCounter("router.response_controller.unsupported")
+
+	// Responses compressed by the router, tagged by content encoding.
+	compressedResponses = stats.NewCounter("router.compression.responses")
+
+	// Requests received by the router, tagged by service name and outcome.
+	requestCounter = stats.NewCounter("router.requests")
+	requestTimer   = stats.NewTimer("router.request.time")
+)
+
+// Outcomes of resolving a service name.
+const (
+	resolveOK       = "ok"
+	resolveNotFound = "not_found"
+	resolveError    = "error"
+)
+
+// Outcomes of handling a request.
+const (
+	requestOK            = "ok"
+	requestWrongDomain   = "wrong_domain"
+	requestResolverError = "resolver_error"
+	requestNotFound      = "not_found"
+	requestUnhealthy     = "no_healthy_endpoints"
+	requestUnknownLimit  = "unknown_limit"
+	requestBodyTooLarge  = "body_too_large"
+	requestForwardError  = "forward_error"
+	requestTimeout       = "timeout"
+	requestAborted       = "client_aborted"
+	requestUnsupported   = "unsupported"
+)
+
+func observeResolve(start time.Time, name string, srv []service, err error) {
+	outcome := resolveOK
+
+	switch {
+	case err != nil:
+		outcome, name = resolveError, ""
+	case len(srv) == 0:
+		outcome, name = resolveNotFound, ""
+	}
+
+	resolveTimer.Clone(serviceTags(name, outcome, -1)...).Add(time.Since(start))
+}
+
+func observeAttempt(service string, attempt int, err error) {
+	outcome := "ok"
+
+	// Attempts interrupted by the client are counted apart so they don't look
+	// like failures of the service.
+	switch err {
+	case nil:
+	case context.Canceled, context.DeadlineExceeded:
+		outcome = "aborted"
+	default:
+		outcome = "error"
+	}
+
+	attemptCounter.Clone(serviceTags(service, outcome, attempt)...).Incr()
+}
+
+func observeRetry(service string, attempt int) {
+	retryCounter.Clone(serviceTags(service, "", attempt)...).Incr()
+	ejectionCounter.Clone(serviceTags(service, "", -1)...).Incr()
+}
+
+func observeFiltered(service string, count int) {
+	if count != 0 {
+		blacklistFiltered.Clone(serviceTags(service, "", -1)...).Add(float64(count))
+	}
+}
+
+func observeRequest(start time.Time, service string, outcome string) {
+	tags := serviceTags(service, outcome, -1)
+	requestCounter.Clone(tags...).Incr()
+	requestTimer.Clone(tags...).Add(time.Since(start))
+}
+
+// serviceTags builds the list of tags for the given service, outcome and
+// attempt number, empty values and negative attempts are omitted.
+func serviceTags(service string, outcome string, attempt int) []stats.Tag {
+	tags := make([]stats.Tag, 0, 3)
+
+	if len(service) != 0 {
+		tags = append(tags, stats.Tag{Name: "service", Value: service})
+	}
+
+	if len(outcome) != 0 {
+		tags = append(tags, stats.Tag{Name: "outcome", Value: outcome})
+	}
+
+	if attempt >= 0 {
+		tags = append(tags, stats.Tag{Name: "attempt", Value: strconv.Itoa(attempt)})
+	}
+
+	return tags
+}
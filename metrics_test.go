@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/stats"
+)
+
+func TestServiceTags(t *testing.T) {
+	tests := []struct {
+		service string
+		outcome string
+		attempt int
+		tags    []stats.Tag
+	}{
+		{
+			attempt: -1,
+			tags:    []stats.Tag{},
+		},
+		{
+			service: "host-1",
+			outcome: "ok",
+			attempt: 0,
+			tags: []stats.Tag{
+				{Name: "service", Value: "host-1"},
+				{Name: "outcome", Value: "ok"},
+				{Name: "attempt", Value: "0"},
+			},
+		},
+		{
+			outcome: requestNotFound,
+			attempt: -1,
+			tags:    []stats.Tag{{Name: "outcome", Value: "not_found"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			if tags := serviceTags(test.service, test.outcome, test.attempt); !reflect.DeepEqual(tags, test.tags) {
+				t.Errorf("\n%#v\n%#v", tags, test.tags)
+			}
+		})
+	}
+}
@@ -14,11 +14,19 @@ func preferred(tag string, rslv resolver) resolver {
 		if srv, err = rslv.resolve(name); err != nil {
 			return
 		}
+		preferServices(tag, srv)
+		return
+	})
+}
+
+// preferServices reorders srv in place so services with a tag matching the
+// argument come first.
+func preferServices(tag string, srv []service) {
+	if len(tag) != 0 {
 		// Using a stable sort is important to preserve the previous service
 		// list order among preferred and non-preferred entries.
 		sort.Stable(preferredServices{tag, srv})
-		return
-	})
+	}
 }
 
 type preferredServices struct {
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// The prometheusHandler type is a stats handler that aggregates the metrics
+// produced by the program and exposes them over http in the prometheus text
+// format.
+//
+// Counters are summed, gauges keep the last value they were set to, and
+// histograms are accumulated into a fixed set of buckets chosen from the unit
+// of the metric.
+//
+// Series that were not updated for the ttl are dropped, tags like service
+// names come and go and would otherwise grow the memory usage without limit.
+type prometheusHandler struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	metrics map[string]*prometheusMetric
+}
+
+type prometheusMetric struct {
+	typ     string
+	buckets []float64
+	series  map[string]*prometheusSeries
+}
+
+type prometheusSeries struct {
+	labels  string
+	value   float64
+	count   uint64
+	buckets []uint64
+	updated time.Time
+}
+
+// The upper bounds of histogram buckets of metrics measured in seconds.
+var prometheusTimeBuckets = []float64{
+	0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// The upper bounds of histogram buckets of metrics measured in bytes.
+var prometheusByteBuckets = []float64{
+	64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216,
+}
+
+// prometheusSeriesTTL is how long series are kept after their last update.
+const prometheusSeriesTTL = 10 * time.Minute
+
+func newPrometheusHandler() *prometheusHandler {
+	return &prometheusHandler{
+		ttl:     prometheusSeriesTTL,
+		metrics: make(map[string]*prometheusMetric),
+	}
+}
+
+// prometheusBuckets returns the histogram buckets of the metric, sizes are
+// reported by metrics named *.bytes or *.size and everything else is assumed
+// to be a duration in seconds.
+func prometheusBuckets(name string) []float64 {
+	if strings.HasSuffix(name, ".bytes") || strings.HasSuffix(name, ".size") {
+		return prometheusByteBuckets
+	}
+	return prometheusTimeBuckets
+}
+
+func (h *prometheusHandler) HandleMetric(m *stats.Metric) {
+	var typ string
+
+	switch m.Type {
+	case stats.CounterType:
+		typ = "counter"
+	case stats.GaugeType:
+		typ = "gauge"
+	case stats.HistogramType:
+		typ = "histogram"
+	default:
+		return
+	}
+
+	name := prometheusName(m.Name)
+	labels := prometheusLabels(m.Tags)
+	now := time.Now()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	metric := h.metrics[name]
+
+	if metric == nil {
+		metric = &prometheusMetric{typ: typ, series: make(map[string]*prometheusSeries)}
+		if typ == "histogram" {
+			metric.buckets = prometheusBuckets(m.Name)
+		}
+		h.metrics[name] = metric
+	} else if metric.typ != typ {
+		return // the prometheus format doesn't allow mixing metric types
+	}
+
+	series := metric.series[labels]
+
+	if series == nil {
+		series = &prometheusSeries{labels: labels}
+		if typ == "histogram" {
+			series.buckets = make([]uint64, len(metric.buckets))
+		}
+		metric.series[labels] = series
+	}
+
+	series.updated = now
+
+	switch typ {
+	case "counter":
+		series.value += m.Value
+	case "gauge":
+		series.value = m.Value
+	case "histogram":
+		series.value += m.Value
+		series.count++
+		for i, le := range metric.buckets {
+			if m.Value <= le {
+				series.buckets[i]++
+			}
+		}
+	}
+}
+
+func (h *prometheusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.expire(time.Now())
+
+	names := make([]string, 0, len(h.metrics))
+	for name := range h.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metric := h.metrics[name]
+		series := make([]*prometheusSeries, 0, len(metric.series))
+		for _, s := range metric.series {
+			series = append(series, s)
+		}
+		sort.Slice(series, func(i int, j int) bool { return series[i].labels < series[j].labels })
+
+		b.WriteString("# TYPE " + name + " " + metric.typ + "\n")
+
+		for _, s := range series {
+			if metric.typ != "histogram" {
+				writePrometheusSample(b, name, s.labels, "", s.value)
+				continue
+			}
+			for i, le := range metric.buckets {
+				writePrometheusSample(b, name+"_bucket", s.labels, `le="`+formatPrometheusValue(le)+`"`, float64(s.buckets[i]))
+			}
+			writePrometheusSample(b, name+"_bucket", s.labels, `le="+Inf"`, float64(s.count))
+			writePrometheusSample(b, name+"_sum", s.labels, "", s.value)
+			writePrometheusSample(b, name+"_count", s.labels, "", float64(s.count))
+		}
+	}
+}
+
+// expire drops the series that were not updated for the ttl, and the metrics
+// left without series. It must be called with the mutex locked.
+func (h *prometheusHandler) expire(now time.Time) {
+	if h.ttl == 0 {
+		return
+	}
+
+	for name, metric := range h.metrics {
+		for labels, s := range metric.series {
+			if now.Sub(s.updated) > h.ttl {
+				delete(metric.series, labels)
+			}
+		}
+		if len(metric.series) == 0 {
+			delete(h.metrics, name)
+		}
+	}
+}
+
+func writePrometheusSample(b *bufio.Writer, name string, labels string, extra string, value float64) {
+	b.WriteString(name)
+
+	switch {
+	case len(labels) != 0 && len(extra) != 0:
+		b.WriteString("{" + labels + "," + extra + "}")
+	case len(labels) != 0:
+		b.WriteString("{" + labels + "}")
+	case len(extra) != 0:
+		b.WriteString("{" + extra + "}")
+	}
+
+	b.WriteString(" " + formatPrometheusValue(value) + "\n")
+}
+
+func formatPrometheusValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// prometheusName converts a metric or tag name to a valid prometheus name,
+// replacing unsupported characters with underscores.
+func prometheusName(s string) string {
+	b := []byte(s)
+
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i != 0:
+		default:
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
+
+func prometheusLabels(tags []stats.Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	labels := make([]string, 0, len(tags))
+
+	for _, t := range tags {
+		labels = append(labels, strings.Replace(prometheusName(t.Name), ":", "_", -1)+`="`+prometheusEscape(t.Value)+`"`)
+	}
+
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+func prometheusEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestPrometheus(t *testing.T) {
+	h := newPrometheusHandler()
+
+	for _, m := range []stats.Metric{
+		{Type: stats.CounterType, Name: "router.requests", Tags: []stats.Tag{{Name: "service", Value: "host-1"}}, Value: 1},
+		{Type: stats.CounterType, Name: "router.requests", Tags: []stats.Tag{{Name: "service", Value: "host-1"}}, Value: 2},
+		{Type: stats.CounterType, Name: "router.requests", Tags: []stats.Tag{{Name: "service", Value: `"2"`}}, Value: 1},
+		{Type: stats.GaugeType, Name: "router.blacklist.size", Value: 3},
+		{Type: stats.GaugeType, Name: "router.blacklist.size", Value: 2},
+		{Type: stats.HistogramType, Name: "router.resolve.time", Value: 0.02},
+		{Type: stats.HistogramType, Name: "router.resolve.time", Value: 20},
+	} {
+		m := m
+		h.HandleMetric(&m)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(w.Body)
+
+	for _, line := range []string{
+		"# TYPE router_blacklist_size gauge",
+		"router_blacklist_size 2",
+		"# TYPE router_requests counter",
+		`router_requests{service="\"2\""} 1`,
+		`router_requests{service="host-1"} 3`,
+		"# TYPE router_resolve_time histogram",
+		`router_resolve_time_bucket{le="0.01"} 0`,
+		`router_resolve_time_bucket{le="0.025"} 1`,
+		`router_resolve_time_bucket{le="+Inf"} 2`,
+		"router_resolve_time_sum 20.02",
+		"router_resolve_time_count 2",
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, b)
+		}
+	}
+}
+
+func TestPrometheusName(t *testing.T) {
+	tests := []struct {
+		name string
+		res  string
+	}{
+		{"", ""},
+		{"http.req.count", "http_req_count"},
+		{"go:gc", "go:gc"},
+		{"1.x", "__x"},
+		{"conn-open", "conn_open"},
+	}
+
+	for _, test := range tests {
+		if res := prometheusName(test.name); res != test.res {
+			t.Errorf("%q: %q != %q", test.name, res, test.res)
+		}
+	}
+}
+
+func TestPrometheusBuckets(t *testing.T) {
+	h := newPrometheusHandler()
+
+	for _, m := range []stats.Metric{
+		{Type: stats.HistogramType, Name: "http.res.body.bytes", Value: 2000},
+		{Type: stats.HistogramType, Name: "http.res.body.bytes", Value: 50000},
+	} {
+		m := m
+		h.HandleMetric(&m)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(w.Body)
+
+	for _, line := range []string{
+		`http_res_body_bytes_bucket{le="1024"} 0`,
+		`http_res_body_bytes_bucket{le="4096"} 1`,
+		`http_res_body_bytes_bucket{le="65536"} 2`,
+		`http_res_body_bytes_bucket{le="+Inf"} 2`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, b)
+		}
+	}
+}
+
+func TestPrometheusExpire(t *testing.T) {
+	h := newPrometheusHandler()
+
+	for _, m := range []stats.Metric{
+		{Type: stats.CounterType, Name: "router.requests", Tags: []stats.Tag{{Name: "service", Value: "host-1"}}, Value: 1},
+		{Type: stats.CounterType, Name: "router.requests", Tags: []stats.Tag{{Name: "service", Value: "host-2"}}, Value: 1},
+	} {
+		m := m
+		h.HandleMetric(&m)
+	}
+
+	h.metrics["router_requests"].series[`service="host-1"`].updated = time.Now().Add(-2 * h.ttl)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(w.Body)
+
+	if strings.Contains(string(b), "host-1") {
+		t.Errorf("the stale series wasn't dropped:\n%s", b)
+	}
+
+	if !strings.Contains(string(b), `router_requests{service="host-2"} 1`) {
+		t.Errorf("the live series was dropped:\n%s", b)
+	}
+}
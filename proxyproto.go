@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// The proxyListener type wraps a net.Listener to accept connections from a
+// load balancer that prefixes them with a PROXY protocol header (v1 or v2),
+// see http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+//
+// The connections returned by Accept report the address of the original client
+// from their RemoteAddr method. The listener closes connections coming from
+// addresses that are not in the list of trusted sources, otherwise anyone able
+// to reach the router could pretend to be any client. An empty list trusts no
+// source.
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+	trusted trustedProxies
+}
+
+func newProxyListener(lstn net.Listener, timeout time.Duration, trusted trustedProxies) net.Listener {
+	return &proxyListener{
+		Listener: lstn,
+		timeout:  timeout,
+		trusted:  trusted,
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.trusted.contains(remoteIP(conn.RemoteAddr().String())) {
+			proxyRejected.Incr()
+			log.WithField("address", conn.RemoteAddr().String()).Warn("rejecting connection from an untrusted PROXY protocol source")
+			conn.Close()
+			continue
+		}
+
+		return &proxyConn{Conn: conn, timeout: l.timeout}, nil
+	}
+}
+
+// The proxyConn type reads the PROXY protocol header the first time its Read
+// or RemoteAddr methods are called, this way the accept loop never blocks on
+// slow clients.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+	once    sync.Once
+	reader  *bufio.Reader
+	remote  net.Addr
+	err     error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.init)
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.init)
+	return c.remote
+}
+
+func (c *proxyConn) init() {
+	c.reader = bufio.NewReader(c.Conn)
+	c.remote = c.Conn.RemoteAddr()
+
+	if c.timeout != 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	var addr net.Addr
+
+	if addr, c.err = readProxyHeader(c.reader); c.err != nil {
+		proxyRejected.Incr()
+		log.WithFields(log.Fields{
+			"address": c.remote.String(),
+			"error":   c.err,
+		}).Warn("rejecting connection with an invalid PROXY protocol header")
+		c.Conn.Close()
+		return
+	}
+
+	if addr != nil {
+		c.remote = addr
+	}
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// readProxyHeader reads a PROXY protocol header from r, it returns the address
+// of the original client, or nil if the header didn't carry one (LOCAL or
+// UNKNOWN connections).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyV2Signature))
+
+	switch {
+	case err == nil && bytes.Equal(b, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	case len(b) >= len(proxyV1Prefix) && bytes.Equal(b[:len(proxyV1Prefix)], proxyV1Prefix):
+		return readProxyHeaderV1(r)
+	case err != nil:
+		return nil, err
+	default:
+		return nil, errProxyHeader
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The maximum length of a v1 header is 107 bytes including the CRLF.
+	const maxLen = 107
+	line := make([]byte, 0, maxLen)
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if line = append(line, c); c == '\n' {
+			break
+		}
+		if len(line) == maxLen {
+			return nil, errProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	version, command := hdr[12]>>4, hdr[12]&0xF
+	family := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:]))
+
+	if version != 2 || command > 1 {
+		return nil, errProxyHeader
+	}
+
+	body := make([]byte, length)
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if command == 0 { // LOCAL, health checks from the load balancer
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+
+	default: // UNSPEC, UDP or unix sockets, the address is not used
+		return nil, nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		err    bool
+	}{
+		{
+			name:   "v1 tcp4",
+			header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+			addr:   "192.168.0.1:56324",
+		},
+		{
+			name:   "v1 tcp6",
+			header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			addr:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 unknown",
+			header: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:   "v1 mismatched family",
+			header: "PROXY TCP6 192.168.0.1 192.168.0.11 56324 443\r\n",
+			err:    true,
+		},
+		{
+			name:   "v2 tcp4",
+			header: "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbb",
+			addr:   "192.168.0.1:56324",
+		},
+		{
+			name:   "v2 local",
+			header: "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+		},
+		{
+			name:   "missing",
+			header: "GET / HTTP/1.1\r\n",
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(test.header + "GET / HTTP/1.1\r\n\r\n"))
+			addr, err := readProxyHeader(r)
+
+			switch {
+			case test.err:
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			case len(test.addr) == 0 && addr != nil:
+				t.Error("unexpected address:", addr)
+			case len(test.addr) != 0 && (addr == nil || addr.String() != test.addr):
+				t.Errorf("bad address: %v != %s", addr, test.addr)
+			}
+
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("the header wasn't fully consumed: %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := parseTrustedProxies("127.0.0.0/8")
+	lstn := newProxyListener(l, time.Second, trusted)
+	defer lstn.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nHello World!"))
+		c.Close()
+	}()
+
+	conn, err := lstn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != "1.2.3.4:1234" {
+		t.Error("bad remote address:", addr)
+	}
+
+	if b, _ := ioutil.ReadAll(conn); string(b) != "Hello World!" {
+		t.Errorf("bad payload: %q", b)
+	}
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := parseTrustedProxies("10.0.0.0/8")
+	lstn := newProxyListener(l, time.Second, trusted)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n"))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lstn.Close()
+	}()
+
+	if conn, err := lstn.Accept(); err == nil {
+		conn.Close()
+		t.Error("a connection from an untrusted source was accepted")
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("the connection from an untrusted source wasn't closed")
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "errors"
+
 // The resolver interface is implemented by diverse components involved in
 // service name resolution.
 type resolver interface {
@@ -11,11 +13,31 @@ type resolver interface {
 	// of the result list.
 	//
 	// If the name cannot be resolved because it could not be found the method
-	// should return an empty service list, errors should be kept for runtime
-	// issues that prevented the resolver from completing the request.
+	// should return an empty service list or errUnknownService, and
+	// errNoHealthyEndpoints if the service exists but none of its endpoints
+	// can be used. Resolvers that refuse to look up a name because too many
+	// unknown names were queried return errUnknownLimit. Other errors should
+	// be kept for runtime issues that prevented the resolver from completing
+	// the request.
 	resolve(name string) (srv []service, err error)
 }
 
+var (
+	// errUnknownService is returned by resolvers that know a service doesn't
+	// exist without querying the service discovery backend.
+	errUnknownService = errors.New("unknown service")
+
+	// errNoHealthyEndpoints is returned by resolvers when a service exists but
+	// all its endpoints were excluded, for example because they are
+	// black-listed.
+	errNoHealthyEndpoints = errors.New("no healthy endpoints")
+
+	// errUnknownLimit is returned by resolvers that didn't look up a name
+	// because too many unknown names were queried recently, the service may
+	// exist so the error must not be cached as a negative result.
+	errUnknownLimit = errors.New("too many unknown services")
+)
+
 // The resolverFunc type implements the resolver interface and makes it possible
 // for simple functions to be used as resolvers.
 type resolverFunc func(string) ([]service, error)
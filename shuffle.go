@@ -9,12 +9,15 @@ func shuffled(rslv resolver) resolver {
 		if srv, err = rslv.resolve(name); err != nil {
 			return
 		}
-
-		for i := range srv {
-			j := rand.Intn(i + 1)
-			srv[i], srv[j] = srv[j], srv[i]
-		}
-
+		shuffleServices(srv)
 		return
 	})
 }
+
+// shuffleServices randomizes the order of srv in place.
+func shuffleServices(srv []service) {
+	for i := range srv {
+		j := rand.Intn(i + 1)
+		srv[i], srv[j] = srv[j], srv[i]
+	}
+}
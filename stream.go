@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streaming returns true if the response must be forwarded as a stream, that
+// is flushed to the client as data is received instead of being buffered.
+//
+// Server-Sent Events and gRPC responses are always streamed, as well as
+// responses with no known length (chunked long-polls for example) and every
+// response of services configured to stream.
+func streaming(res *http.Response, cfg serviceConfig) bool {
+	if cfg.stream || res.ContentLength < 0 {
+		return true
+	}
+
+	contentType := res.Header.Get("Content-Type")
+
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/event-stream" {
+		return true
+	}
+
+	return isGRPC(contentType)
+}
+
+// copyStream copies bytes from r to w, flushing w after each write when
+// flushInterval is zero or at most flushInterval after data was written
+// otherwise.
+//
+// Streams may be open for much longer than the write timeout, it's replaced by
+// idleTimeout which applies to each write to the client, and the stream is
+// closed with errStreamIdle when r produced no data for idleTimeout. A zero
+// idleTimeout disables both limits.
+func copyStream(w http.ResponseWriter, r io.ReadCloser, flushInterval time.Duration, idleTimeout time.Duration) error {
+	b := buffers.get()
+	defer buffers.put(b)
+
+	rc := http.NewResponseController(w)
+	sw := &streamWriter{w: w, rc: rc, interval: flushInterval}
+	defer sw.close()
+
+	var idle uint32
+	var timer *time.Timer
+
+	if idleTimeout != 0 {
+		timer = time.AfterFunc(idleTimeout, func() {
+			atomic.StoreUint32(&idle, 1)
+			r.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// The response header is sent right away so clients know the stream was
+	// established before the service sends any data.
+	sw.extend(idleTimeout)
+	sw.flush()
+
+	for {
+		n, err := r.Read(b)
+
+		if n > 0 {
+			if timer != nil {
+				timer.Reset(idleTimeout)
+			}
+			sw.extend(idleTimeout)
+
+			if _, werr := sw.write(b[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err != nil {
+			switch {
+			case atomic.LoadUint32(&idle) != 0:
+				return errStreamIdle
+			case err == io.EOF:
+				return nil
+			default:
+				return err
+			}
+		}
+	}
+}
+
+// errStreamIdle is returned by copyStream when the service didn't send data for
+// the stream idle timeout.
+var errStreamIdle = errors.New("the stream was idle for too long")
+
+// The streamWriter type serializes writes to a response with the flushes that
+// are delayed by the flush interval.
+type streamWriter struct {
+	mutex    sync.Mutex
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	interval time.Duration
+	timer    *time.Timer // pending flush, nil if none
+	closed   bool
+}
+
+func (sw *streamWriter) write(b []byte) (n int, err error) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if n, err = sw.w.Write(b); err != nil {
+		return
+	}
+
+	switch {
+	case sw.interval == 0:
+		responseControl("flush", sw.rc.Flush())
+	case sw.timer == nil:
+		sw.timer = time.AfterFunc(sw.interval, sw.flush)
+	}
+
+	return
+}
+
+func (sw *streamWriter) flush() {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	// The response must not be used anymore once the handler returned.
+	if !sw.closed {
+		responseControl("flush", sw.rc.Flush())
+	}
+	sw.timer = nil
+}
+
+// extend pushes the write deadline of the response timeout in the future, or
+// clears it if timeout is zero.
+func (sw *streamWriter) extend(timeout time.Duration) {
+	var deadline time.Time
+
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	responseControl("write_deadline", sw.rc.SetWriteDeadline(deadline))
+}
+
+// close flushes pending data and prevents delayed flushes from using the
+// response after copyStream returned.
+func (sw *streamWriter) close() {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.timer != nil {
+		sw.timer.Stop()
+		sw.timer = nil
+		responseControl("flush", sw.rc.Flush())
+	}
+
+	sw.closed = true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreaming(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		length      int64
+		stream      bool
+		res         bool
+	}{
+		{"plain", "text/plain", 42, false, false},
+		{"chunked", "text/plain", -1, false, true},
+		{"event-stream", "text/event-stream; charset=utf-8", 42, false, true},
+		{"grpc", "application/grpc+proto", 42, false, true},
+		{"configured", "application/json", 42, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := &http.Response{
+				Header:        http.Header{"Content-Type": {test.contentType}},
+				ContentLength: test.length,
+			}
+			cfg := defaultServiceConfig
+			cfg.stream = test.stream
+
+			if s := streaming(res, cfg); s != test.res {
+				t.Errorf("%t != %t", s, test.res)
+			}
+		})
+	}
+}
+
+func TestCopyStream(t *testing.T) {
+	t.Run("flush", func(t *testing.T) {
+		w := httptest.NewRecorder()
+
+		if err := copyStream(w, ioutil.NopCloser(strings.NewReader("Hello World!")), 0, 0); err != nil {
+			t.Error(err)
+		}
+
+		if !w.Flushed {
+			t.Error("the response wasn't flushed")
+		}
+
+		if s := w.Body.String(); s != "Hello World!" {
+			t.Errorf("bad body: %q", s)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		r, w := io.Pipe()
+		defer w.Close()
+
+		if err := copyStream(httptest.NewRecorder(), r, time.Millisecond, 10*time.Millisecond); err != errStreamIdle {
+			t.Error("bad error:", err)
+		}
+	})
+}
+
+func TestEventStream(t *testing.T) {
+	next := make(chan struct{})
+
+	url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Write([]byte("data: 1\n\n"))
+		res.(http.Flusher).Flush()
+		<-next
+		res.Write([]byte("data: 2\n\n"))
+	}), httpServerConfig{})
+	defer stop()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = "host-1.local"
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	defer close(next)
+
+	// The first event must reach the client while the service is still
+	// holding the stream open.
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "data: 1\n" {
+		t.Errorf("bad event: %q", line)
+	}
+}
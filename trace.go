@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+)
+
+type traceID [16]byte
+
+type spanID [8]byte
+
+func (id traceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id spanID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id traceID) valid() bool { return id != traceID{} }
+
+func (id spanID) valid() bool { return id != spanID{} }
+
+func newTraceID() (id traceID) {
+	for !id.valid() {
+		putUint64(id[:8], rand.Uint64())
+		putUint64(id[8:], rand.Uint64())
+	}
+	return
+}
+
+func newSpanID() (id spanID) {
+	for !id.valid() {
+		putUint64(id[:], rand.Uint64())
+	}
+	return
+}
+
+func putUint64(b []byte, v uint64) {
+	for i := 7; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
+// Formats of B3 headers that a span propagates to the services, W3C trace
+// context headers are always propagated.
+const (
+	b3None = iota
+	b3Multi
+	b3Single
+)
+
+// The span type represents an operation traced by the router. All methods
+// support being called on a nil span, which is what the program uses when
+// tracing is disabled.
+type span struct {
+	tracer  *tracer
+	trace   traceID
+	id      spanID
+	parent  spanID
+	sampled bool
+	state   string
+	b3      int
+	name    string
+	kind    string
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     string
+}
+
+// Kinds of spans, they match the names used by zipkin.
+const (
+	spanServer   = "SERVER"
+	spanClient   = "CLIENT"
+	spanInternal = ""
+)
+
+// child starts a new span within the same trace as s.
+func (s *span) child(name string, kind string) *span {
+	if s == nil {
+		return nil
+	}
+	return &span{
+		tracer:  s.tracer,
+		trace:   s.trace,
+		id:      newSpanID(),
+		parent:  s.id,
+		sampled: s.sampled,
+		state:   s.state,
+		b3:      s.b3,
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+	}
+}
+
+func (s *span) set(key string, value string) {
+	if s != nil {
+		if s.attrs == nil {
+			s.attrs = make(map[string]string)
+		}
+		s.attrs[key] = value
+	}
+}
+
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// finish records the end of the span and submits it to the exporter if the
+// trace is sampled.
+func (s *span) finish() {
+	if s != nil {
+		s.end = time.Now()
+		if s.sampled {
+			s.tracer.submit(s)
+		}
+	}
+}
+
+// inject writes the headers propagating the span to a downstream service.
+func (s *span) inject(hdr http.Header) {
+	if s == nil {
+		return
+	}
+
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+
+	hdr.Set("Traceparent", "00-"+s.trace.String()+"-"+s.id.String()+"-"+flags)
+
+	if len(s.state) != 0 {
+		hdr.Set("Tracestate", s.state)
+	}
+
+	sampled := flags[1:]
+
+	switch s.b3 {
+	case b3Single:
+		hdr.Set("B3", s.trace.String()+"-"+s.id.String()+"-"+sampled+"-"+s.parent.String())
+	case b3Multi:
+		hdr.Set("X-B3-Traceid", s.trace.String())
+		hdr.Set("X-B3-Spanid", s.id.String())
+		hdr.Set("X-B3-Parentspanid", s.parent.String())
+		hdr.Set("X-B3-Sampled", sampled)
+	default:
+		// Invalid B3 headers would point at a span that isn't the parent of
+		// the request, they're removed instead of being forwarded.
+		for _, field := range [...]string{"B3", "X-B3-Traceid", "X-B3-Spanid", "X-B3-Parentspanid", "X-B3-Sampled", "X-B3-Flags"} {
+			hdr.Del(field)
+		}
+	}
+}
+
+// b3Format returns the format of the B3 headers in hdr, b3None if there are
+// none.
+func b3Format(hdr http.Header) int {
+	switch {
+	case len(hdr.Get("B3")) != 0:
+		return b3Single
+	case len(hdr.Get("X-B3-Traceid")) != 0:
+		return b3Multi
+	default:
+		return b3None
+	}
+}
+
+// The tracer type creates spans for requests handled by the router and sends
+// the sampled ones to a collector in batches.
+type tracer struct {
+	exporter spanExporter
+	sample   float64
+	queue    chan *span
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type tracerConfig struct {
+	exporter      spanExporter
+	sample        float64
+	batchSize     int
+	flushInterval time.Duration
+}
+
+func newTracer(config tracerConfig) *tracer {
+	t := &tracer{
+		exporter: config.exporter,
+		sample:   config.sample,
+		queue:    make(chan *span, 4*config.batchSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run(config.batchSize, config.flushInterval)
+	return t
+}
+
+// start extracts the trace context from the W3C or B3 headers of req, and
+// returns the server span for the request. A new trace is started if req had
+// no valid trace context.
+func (t *tracer) start(req *http.Request) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{
+		tracer: t,
+		id:     newSpanID(),
+		name:   req.Method,
+		kind:   spanServer,
+		start:  time.Now(),
+	}
+
+	switch {
+	case extractTraceparent(s, req.Header):
+		// B3 headers sent along with traceparent are rewritten with the new
+		// span, services reading them must not see the client's span as their
+		// parent.
+		s.b3 = b3Format(req.Header)
+	case extractB3(s, req.Header):
+	default:
+		s.trace = newTraceID()
+		s.sampled = rand.Float64() < t.sample
+	}
+
+	return s
+}
+
+func (t *tracer) submit(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		// The queue is full, the collector is likely unavailable and we don't
+		// want to block requests.
+	}
+}
+
+// close flushes the spans that have not been exported yet. The queue is never
+// closed because requests may still be submitting spans, those that arrive
+// after close was called are dropped.
+func (t *tracer) close() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *tracer) run(batchSize int, flushInterval time.Duration) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, batchSize)
+
+	flush := func() {
+		if len(batch) != 0 {
+			if err := t.exporter.export(batch); err != nil {
+				log.WithFields(log.Fields{
+					"spans": len(batch),
+					"error": err,
+				}).Warn("failed to export spans")
+			}
+			batch = batch[:0]
+		}
+	}
+
+	add := func(s *span) {
+		if batch = append(batch, s); len(batch) == batchSize {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			add(s)
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			// Spans that were queued before close was called are exported.
+			for {
+				select {
+				case s := <-t.queue:
+					add(s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func extractTraceparent(s *span, hdr http.Header) bool {
+	// version-traceid-parentid-flags, future versions may append fields.
+	parts := strings.Split(hdr.Get("Traceparent"), "-")
+
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[0]) != 2 || (parts[0] == "00" && len(parts) != 4) {
+		return false
+	}
+
+	trace, ok1 := parseTraceID(parts[1])
+	parent, ok2 := parseSpanID(parts[2])
+	flags, err := hex.DecodeString(parts[3])
+
+	if !ok1 || !ok2 || err != nil || len(flags) != 1 {
+		return false
+	}
+
+	s.trace = trace
+	s.parent = parent
+	s.sampled = (flags[0] & 1) != 0
+	s.state = hdr.Get("Tracestate")
+	return true
+}
+
+func extractB3(s *span, hdr http.Header) bool {
+	var trace, parent, sampled string
+
+	if b3 := hdr.Get("B3"); len(b3) != 0 {
+		parts := strings.Split(b3, "-")
+		if len(parts) < 2 {
+			return false // sampling decision only, e.g. "b3: 0"
+		}
+		trace, parent = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+		s.b3 = b3Single
+	} else {
+		trace = hdr.Get("X-B3-Traceid")
+		parent = hdr.Get("X-B3-Spanid")
+		sampled = hdr.Get("X-B3-Sampled")
+		if hdr.Get("X-B3-Flags") == "1" {
+			sampled = "d"
+		}
+		s.b3 = b3Multi
+	}
+
+	// B3 allows 64 bits trace ids.
+	if len(trace) == 16 {
+		trace = "0000000000000000" + trace
+	}
+
+	var ok1, ok2 bool
+	s.trace, ok1 = parseTraceID(trace)
+	s.parent, ok2 = parseSpanID(parent)
+
+	if !ok1 || !ok2 {
+		s.b3 = b3None
+		return false
+	}
+
+	switch sampled {
+	case "0", "false":
+		s.sampled = false
+	default:
+		// Absent sampling decisions are deferred to the router, which samples
+		// all requests that are part of a trace.
+		s.sampled = true
+	}
+
+	return true
+}
+
+func parseTraceID(s string) (id traceID, ok bool) {
+	if len(s) == 32 {
+		_, err := hex.Decode(id[:], []byte(s))
+		ok = err == nil && id.valid()
+	}
+	return
+}
+
+func parseSpanID(s string) (id spanID, ok bool) {
+	if len(s) == 16 {
+		_, err := hex.Decode(id[:], []byte(s))
+		ok = err == nil && id.valid()
+	}
+	return
+}
+
+// The spanExporter interface is implemented by the types that send spans to a
+// trace collector.
+type spanExporter interface {
+	export(spans []*span) error
+}
+
+// The zipkinExporter sends spans to a zipkin compatible collector using the
+// JSON v2 API.
+type zipkinExporter struct {
+	url     string
+	service string
+}
+
+func (e zipkinExporter) export(spans []*span) error {
+	type endpoint struct {
+		ServiceName string `json:"serviceName"`
+	}
+
+	type zipkinSpan struct {
+		TraceID       string            `json:"traceId"`
+		ID            string            `json:"id"`
+		ParentID      string            `json:"parentId,omitempty"`
+		Name          string            `json:"name"`
+		Kind          string            `json:"kind,omitempty"`
+		Timestamp     int64             `json:"timestamp"`
+		Duration      int64             `json:"duration"`
+		LocalEndpoint endpoint          `json:"localEndpoint"`
+		Tags          map[string]string `json:"tags,omitempty"`
+	}
+
+	list := make([]zipkinSpan, 0, len(spans))
+
+	for _, s := range spans {
+		z := zipkinSpan{
+			TraceID:       s.trace.String(),
+			ID:            s.id.String(),
+			Name:          s.name,
+			Kind:          s.kind,
+			Timestamp:     s.start.UnixNano() / 1000,
+			Duration:      int64(s.end.Sub(s.start) / time.Microsecond),
+			LocalEndpoint: endpoint{e.service},
+			Tags:          s.attrs,
+		}
+
+		if s.parent.valid() {
+			z.ParentID = s.parent.String()
+		}
+
+		if len(s.err) != 0 {
+			z.Tags = copyAttrs(s.attrs)
+			z.Tags["error"] = s.err
+		}
+
+		list = append(list, z)
+	}
+
+	return postJSON(e.url, list)
+}
+
+// The otlpExporter sends spans to an OpenTelemetry collector using the JSON
+// encoding of the OTLP/HTTP protocol.
+type otlpExporter struct {
+	url     string
+	service string
+}
+
+func (e otlpExporter) export(spans []*span) error {
+	type value struct {
+		StringValue string `json:"stringValue"`
+	}
+
+	type attribute struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+
+	type status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+
+	type otlpSpan struct {
+		TraceID           string      `json:"traceId"`
+		SpanID            string      `json:"spanId"`
+		ParentSpanID      string      `json:"parentSpanId,omitempty"`
+		TraceState        string      `json:"traceState,omitempty"`
+		Name              string      `json:"name"`
+		Kind              int         `json:"kind"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+		Attributes        []attribute `json:"attributes,omitempty"`
+		Status            status      `json:"status"`
+	}
+
+	list := make([]otlpSpan, 0, len(spans))
+
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.trace.String(),
+			SpanID:            s.id.String(),
+			TraceState:        s.state,
+			Name:              s.name,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+
+		switch s.kind {
+		case spanServer:
+			o.Kind = 2
+		case spanClient:
+			o.Kind = 3
+		default:
+			o.Kind = 1
+		}
+
+		if s.parent.valid() {
+			o.ParentSpanID = s.parent.String()
+		}
+
+		for key, val := range s.attrs {
+			o.Attributes = append(o.Attributes, attribute{key, value{val}})
+		}
+
+		if len(s.err) != 0 {
+			o.Status = status{Code: 2, Message: s.err}
+		}
+
+		list = append(list, o)
+	}
+
+	type scope struct {
+		Name string `json:"name"`
+	}
+
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	type resource struct {
+		Attributes []attribute `json:"attributes"`
+	}
+
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	return postJSON(e.url, struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{
+		ResourceSpans: []resourceSpans{{
+			Resource:   resource{[]attribute{{"service.name", value{e.service}}}},
+			ScopeSpans: []scopeSpans{{Scope: scope{"consul-router"}, Spans: list}},
+		}},
+	})
+}
+
+func copyAttrs(attrs map[string]string) map[string]string {
+	cpy := make(map[string]string, len(attrs)+1)
+	for key, val := range attrs {
+		cpy[key] = val
+	}
+	return cpy
+}
+
+// exportClient is the http client used to send spans to the collector, a
+// collector that doesn't answer must not hold the exporter forever.
+var exportClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(url string, val interface{}) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	res, err := exportClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return errors.New(url + ": " + res.Status)
+	}
+
+	return nil
+}
+
+// newSpanExporter returns the exporter for the given protocol name.
+func newSpanExporter(protocol string, url string, service string) (spanExporter, error) {
+	switch protocol {
+	case "otlp":
+		return otlpExporter{url: url, service: service}, nil
+	case "zipkin":
+		return zipkinExporter{url: url, service: service}, nil
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter: %q", protocol)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTracerStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		hdr     map[string]string
+		trace   string
+		parent  string
+		sampled bool
+		b3      int
+	}{
+		{
+			name:    "traceparent",
+			hdr:     map[string]string{"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "Tracestate": "a=b"},
+			trace:   "0af7651916cd43dd8448eb211c80319c",
+			parent:  "b7ad6b7169203331",
+			sampled: true,
+		},
+		{
+			name:   "traceparent not sampled",
+			hdr:    map[string]string{"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"},
+			trace:  "0af7651916cd43dd8448eb211c80319c",
+			parent: "b7ad6b7169203331",
+		},
+		{
+			name:    "b3 single",
+			hdr:     map[string]string{"B3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"},
+			trace:   "80f198ee56343ba864fe8b2a57d3eff7",
+			parent:  "e457b5a2e4d86bd1",
+			sampled: true,
+			b3:      b3Single,
+		},
+		{
+			name:   "b3 multi",
+			hdr:    map[string]string{"X-B3-Traceid": "64fe8b2a57d3eff7", "X-B3-Spanid": "e457b5a2e4d86bd1", "X-B3-Sampled": "0"},
+			trace:  "000000000000000064fe8b2a57d3eff7",
+			parent: "e457b5a2e4d86bd1",
+			b3:     b3Multi,
+		},
+		{
+			name:    "traceparent and b3",
+			hdr:     map[string]string{"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "B3": "0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1"},
+			trace:   "0af7651916cd43dd8448eb211c80319c",
+			parent:  "b7ad6b7169203331",
+			sampled: true,
+			b3:      b3Single,
+		},
+		{
+			name:    "invalid",
+			hdr:     map[string]string{"Traceparent": "00-00000000000000000000000000000000-b7ad6b7169203331-01"},
+			sampled: true,
+		},
+	}
+
+	tracer := &tracer{sample: 1}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			for key, val := range test.hdr {
+				req.Header.Set(key, val)
+			}
+
+			s := tracer.start(req)
+
+			if len(test.trace) == 0 {
+				if !s.trace.valid() || s.parent.valid() {
+					t.Errorf("a new trace should have been started: %s %s", s.trace, s.parent)
+				}
+			} else if s.trace.String() != test.trace || s.parent.String() != test.parent {
+				t.Errorf("bad trace context: %s %s", s.trace, s.parent)
+			}
+
+			if s.sampled != test.sampled {
+				t.Errorf("bad sampling decision: %t", s.sampled)
+			}
+
+			if s.b3 != test.b3 {
+				t.Errorf("bad b3 format: %d", s.b3)
+			}
+		})
+	}
+}
+
+func TestSpanInject(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-B3-Traceid", "80f198ee56343ba864fe8b2a57d3eff7")
+	req.Header.Set("X-B3-Spanid", "e457b5a2e4d86bd1")
+	req.Header.Set("Tracestate", "a=b")
+
+	s := (&tracer{}).start(req)
+	c := s.child("forward", spanClient)
+	hdr := http.Header{}
+	c.inject(hdr)
+
+	if v := hdr.Get("Traceparent"); v != "00-80f198ee56343ba864fe8b2a57d3eff7-"+c.id.String()+"-01" {
+		t.Error("bad traceparent:", v)
+	}
+
+	if v := hdr.Get("X-B3-Parentspanid"); v != s.id.String() {
+		t.Error("bad parent span id:", v)
+	}
+
+	if v := hdr.Get("X-B3-Traceid"); v != "80f198ee56343ba864fe8b2a57d3eff7" {
+		t.Error("bad trace id:", v)
+	}
+
+	if v := hdr.Get("Tracestate"); len(v) != 0 {
+		t.Error("tracestate must only be propagated with traceparent:", v)
+	}
+
+	// B3 headers that the span doesn't propagate must not be forwarded with
+	// the client's span id.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set("X-B3-Spanid", "b7ad6b7169203331")
+
+	s = (&tracer{}).start(req)
+	s.inject(req.Header)
+
+	if v := req.Header.Get("X-B3-Spanid"); len(v) != 0 {
+		t.Error("stale b3 header was forwarded:", v)
+	}
+
+	var nilSpan *span
+	nilSpan.inject(hdr)
+	nilSpan.child("anything", spanInternal).finish()
+}
+
+func TestSpanExporters(t *testing.T) {
+	for _, protocol := range []string{"otlp", "zipkin"} {
+		t.Run(protocol, func(t *testing.T) {
+			received := make(chan map[string]interface{}, 1)
+
+			collector := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				var body interface{}
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					t.Error(err)
+				}
+				if list, ok := body.([]interface{}); ok { // zipkin
+					body = map[string]interface{}{"spans": list}
+				}
+				received <- body.(map[string]interface{})
+				res.WriteHeader(http.StatusAccepted)
+			}))
+			defer collector.Close()
+
+			exporter, err := newSpanExporter(protocol, collector.URL, "consul-router")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tracer := newTracer(tracerConfig{
+				exporter:      exporter,
+				sample:        1,
+				batchSize:     10,
+				flushInterval: time.Hour,
+			})
+
+			s := tracer.start(httptest.NewRequest("GET", "/", nil))
+			s.child("resolve", spanInternal).finish()
+			s.finish()
+			tracer.close()
+
+			select {
+			case body := <-received:
+				if len(body) == 0 {
+					t.Error("empty export")
+				}
+				b, _ := json.Marshal(body)
+				for _, id := range []string{s.trace.String(), s.id.String()} {
+					if !strings.Contains(string(b), id) {
+						t.Errorf("%s not found in %s", id, b)
+					}
+				}
+			default:
+				t.Error("no spans were exported")
+			}
+		})
+	}
+}
+
+type discardExporter struct{}
+
+func (discardExporter) export([]*span) error { return nil }
+
+func TestTracerCloseWhileSubmitting(t *testing.T) {
+	tracer := newTracer(tracerConfig{
+		exporter:      discardExporter{},
+		sample:        1,
+		batchSize:     1,
+		flushInterval: time.Hour,
+	})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i != 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					tracer.start(httptest.NewRequest("GET", "/", nil)).finish()
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	tracer.close()
+
+	// Requests still in flight submit spans after the tracer was closed,
+	// they must be dropped instead of sending on a closed channel.
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Protocols used to forward requests to service endpoints, endpoints opt into
+// HTTP/2 by being registered with a tag named after the protocol.
+const (
+	protoHTTP1 = "http/1.1"
+	protoH2C   = "h2c"   // cleartext HTTP/2 with prior knowledge
+	protoHTTP2 = "http2" // HTTP/2 over TLS, negotiated with ALPN
+)
+
+// transports maps protocols to the transports used to forward requests with
+// them, http.DefaultTransport is used for protocols that have none. Each
+// transport keeps its own pool of connections per endpoint, HTTP/2 connections
+// are multiplexed so a single connection is usually enough to serve all
+// concurrent requests to an endpoint.
+var transports = map[string]http.RoundTripper{
+	protoH2C:   &http.Transport{Protocols: protocols(protoH2C)},
+	protoHTTP2: &http.Transport{Protocols: protocols(protoHTTP2)},
+}
+
+// protocols returns the set of protocols that a transport forwarding requests
+// with proto must enable.
+func protocols(proto string) *http.Protocols {
+	p := &http.Protocols{}
+
+	switch proto {
+	case protoH2C:
+		p.SetUnencryptedHTTP2(true)
+	case protoHTTP2:
+		p.SetHTTP2(true)
+	default:
+		p.SetHTTP1(true)
+	}
+
+	return p
+}
+
+// endpointProtocol returns the protocol used to forward requests to s.
+func endpointProtocol(s service) string {
+	for _, tag := range s.tags {
+		switch tag {
+		case protoH2C, protoHTTP2:
+			return tag
+		}
+	}
+	return protoHTTP1
+}
+
+// transportFor returns the transport used to forward requests with proto.
+func transportFor(proto string) http.RoundTripper {
+	if t := transports[proto]; t != nil {
+		return t
+	}
+	return http.DefaultTransport
+}
+
+// newTransport creates the transport that forwards requests with proto, using
+// config to verify the certificates of endpoints reached over TLS. The program
+// replaces it to apply its command line configuration.
+var newTransport = func(proto string, config *tls.Config) http.RoundTripper {
+	return &http.Transport{Protocols: protocols(proto), TLSClientConfig: config}
+}
+
+// The tlsSettings type carries the per-service settings used to verify the
+// certificates of endpoints reached over TLS.
+//
+// Endpoints are dialed by IP address, the server name is what the certificate
+// is checked against and what is sent with SNI.
+type tlsSettings struct {
+	serverName string
+	ca         string // PEM file of CA certificates, the system roots if empty
+	insecure   bool   // skip verification of the certificates
+}
+
+type tlsTransportKey struct {
+	proto    string
+	settings tlsSettings
+}
+
+// tlsTransports caches the transports forwarding requests over TLS, endpoints
+// verified with different settings can't share connections.
+var tlsTransports = struct {
+	sync.Mutex
+	m map[tlsTransportKey]http.RoundTripper
+}{
+	m: make(map[tlsTransportKey]http.RoundTripper),
+}
+
+// tlsTransportFor returns the transport used to forward requests with proto to
+// endpoints whose certificates are verified with settings.
+func tlsTransportFor(proto string, settings tlsSettings) (http.RoundTripper, error) {
+	key := tlsTransportKey{proto, settings}
+
+	tlsTransports.Lock()
+	defer tlsTransports.Unlock()
+
+	if t := tlsTransports.m[key]; t != nil {
+		return t, nil
+	}
+
+	config, err := newTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTransport(proto, config)
+	tlsTransports.m[key] = t
+	return t, nil
+}
+
+func newTLSConfig(settings tlsSettings) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         settings.serverName,
+		InsecureSkipVerify: settings.insecure,
+	}
+
+	if len(settings.ca) != 0 {
+		b, err := ioutil.ReadFile(settings.ca)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", settings.ca)
+		}
+	}
+
+	return config, nil
+}
+
+// announceTrailer declares the trailers that a service announced in the
+// header of the response sent to the client, replacing the Trailer field that
+// was copied from the service's response. Trailers can only be sent on chunked
+// responses so the content length is removed.
+func announceTrailer(hdr http.Header, trailer http.Header) {
+	hdr.Del("Trailer")
+
+	if len(trailer) == 0 {
+		return
+	}
+
+	hdr.Del("Content-Length")
+
+	fields := make([]string, 0, len(trailer))
+	for field := range trailer {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	hdr.Set("Trailer", strings.Join(fields, ", "))
+}
+
+// copyTrailer sets the trailers of a response received from a service on the
+// response sent to the client, it must be called after the body was copied.
+func copyTrailer(hdr http.Header, trailer http.Header) {
+	for field, values := range trailer {
+		for _, value := range values {
+			hdr.Add(http.TrailerPrefix+field, value)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestEndpointProtocol(t *testing.T) {
+	tests := []struct {
+		tags  []string
+		proto string
+	}{
+		{nil, protoHTTP1},
+		{[]string{"A", "B"}, protoHTTP1},
+		{[]string{"A", "h2c"}, protoH2C},
+		{[]string{"http2"}, protoHTTP2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.proto, func(t *testing.T) {
+			if proto := endpointProtocol(service{"host-1", 1000, test.tags}); proto != test.proto {
+				t.Errorf("%s != %s", proto, test.proto)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Trailer", "Grpc-Status")
+		res.Header().Set("X-Proto", req.Proto)
+		res.Write([]byte("Hello World!"))
+		res.Header().Set("Grpc-Status", "0")
+	}), httpServerConfig{}, withBackendProtocol(protoH2C))
+	defer stop()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = "host-1.local"
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if proto := res.Header.Get("X-Proto"); proto != "HTTP/2.0" {
+		t.Error("the request wasn't forwarded with HTTP/2:", proto)
+	}
+
+	if string(b) != "Hello World!" {
+		t.Errorf("bad body: %q", b)
+	}
+
+	if status := res.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("the trailer wasn't propagated: %q", status)
+	}
+}
+
+func TestHTTP2TLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		settings   map[string]string
+		ca         bool // write the certificate of the backend to tls-ca
+		status     int
+		serverName string
+	}{
+		{
+			name:       "ca and server name",
+			settings:   map[string]string{"tls-server-name": "example.com"},
+			ca:         true,
+			status:     http.StatusOK,
+			serverName: "example.com",
+		},
+		{
+			name:   "service name not in certificate",
+			ca:     true,
+			status: http.StatusBadGateway,
+		},
+		{
+			name:       "insecure",
+			settings:   map[string]string{"tls-insecure-skip-verify": "true"},
+			status:     http.StatusOK,
+			serverName: "host-1",
+		},
+		{
+			name:   "untrusted",
+			status: http.StatusBadGateway,
+		},
+		{
+			name:     "missing ca",
+			settings: map[string]string{"tls-ca": "/does/not/exist.pem", "tls-server-name": "example.com"},
+			status:   http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var backend *httptest.Server
+			settings := map[string]string{}
+
+			for key, value := range test.settings {
+				settings[key] = value
+			}
+
+			url, stop := newTestRouter(t, "host-1", http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.Header().Set("X-Proto", req.Proto)
+				res.Header().Set("X-Server-Name", req.TLS.ServerName)
+			}), httpServerConfig{
+				source: configMap{"host-1": settings},
+			}, withBackendTLS(&backend))
+			defer stop()
+
+			// The configuration is loaded on the first request, the file
+			// can be written once the backend has a certificate.
+			if test.ca {
+				ca := filepath.Join(t.TempDir(), "ca.pem")
+				cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+
+				if err := ioutil.WriteFile(ca, cert, 0600); err != nil {
+					t.Fatal(err)
+				}
+				settings["tls-ca"] = ca
+			}
+
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Host = "host-1.local"
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Fatal("bad status:", res.StatusCode)
+			}
+
+			if test.status != http.StatusOK {
+				return
+			}
+
+			if proto := res.Header.Get("X-Proto"); proto != "HTTP/2.0" {
+				t.Error("the request wasn't forwarded with HTTP/2:", proto)
+			}
+
+			if name := res.Header.Get("X-Server-Name"); name != test.serverName {
+				t.Errorf("bad server name: %q != %q", name, test.serverName)
+			}
+		})
+	}
+}
+
+func TestAnnounceTrailer(t *testing.T) {
+	hdr := http.Header{
+		"Content-Length": {"12"},
+		"Trailer":        {"Grpc-Status, Grpc-Message"},
+	}
+
+	announceTrailer(hdr, http.Header{"Grpc-Status": nil, "Grpc-Message": nil})
+
+	if trailer := hdr["Trailer"]; len(trailer) != 1 || trailer[0] != "Grpc-Message, Grpc-Status" {
+		t.Errorf("bad trailer announcement: %q", trailer)
+	}
+
+	if _, ok := hdr["Content-Length"]; ok {
+		t.Error("the content length wasn't removed")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// The unknownFilter type is an implementation of a resolver decorator that
+// protects the base resolver from being flooded with queries for names of
+// services that don't exist.
+//
+// The filter caps the number of distinct names that failed to resolve to any
+// endpoint during an interval, once the cap is reached only names that were
+// resolved successfully before are passed to the base resolver. When a catalog
+// is configured the filter also rejects names that are not part of the list of
+// registered services, without querying the base resolver at all.
+//
+// Names that are not in the catalog are reported with errUnknownService, names
+// rejected because the limit was reached are reported with errUnknownLimit as
+// they may belong to services registered after the limit was reached.
+type unknownFilter struct {
+	// Immutable fields of the filter.
+	limit    int
+	interval time.Duration
+	rslv     resolver
+	catalog  *unknownCatalog
+	done     chan struct{}
+
+	// Mutable fields of the filter, the mutex must be locked to access them
+	// concurrently.
+	mutex   sync.Mutex
+	known   map[string]struct{}
+	unknown map[string]struct{}
+	reset   time.Time
+}
+
+type unknownFilterConfig struct {
+	limit    int           // distinct unknown names per interval, zero means no limit
+	interval time.Duration // interval over which unknown names are counted
+	catalog  serviceCatalog
+	refresh  time.Duration // how often the catalog is reloaded
+}
+
+// The serviceCatalog interface is implemented by types that can list the names
+// of all registered services.
+type serviceCatalog interface {
+	services() ([]string, error)
+}
+
+func filterUnknown(config unknownFilterConfig, rslv resolver) *unknownFilter {
+	f := &unknownFilter{
+		limit:    config.limit,
+		interval: config.interval,
+		rslv:     rslv,
+		done:     make(chan struct{}),
+		known:    make(map[string]struct{}),
+		unknown:  make(map[string]struct{}),
+	}
+
+	if config.catalog != nil {
+		f.catalog = &unknownCatalog{}
+		runtime.SetFinalizer(f, func(f *unknownFilter) { close(f.done) })
+		go f.catalog.run(config.catalog, config.refresh, f.done)
+	}
+
+	return f
+}
+
+func (f *unknownFilter) resolve(name string) (srv []service, err error) {
+	if !f.catalog.contains(name) {
+		unknownRejected.Clone(serviceTags("", "catalog", -1)...).Incr()
+		return nil, errUnknownService
+	}
+
+	now := time.Now()
+	f.mutex.Lock()
+
+	if now.After(f.reset) {
+		f.unknown = make(map[string]struct{})
+		f.reset = now.Add(f.interval)
+	}
+
+	_, known := f.known[name]
+	_, seen := f.unknown[name]
+	full := f.limit != 0 && len(f.unknown) >= f.limit
+
+	f.mutex.Unlock()
+
+	if !known && !seen && full {
+		unknownRejected.Clone(serviceTags("", "limit", -1)...).Incr()
+		return nil, errUnknownLimit
+	}
+
+	if srv, err = f.rslv.resolve(name); err != nil {
+		return
+	}
+
+	f.mutex.Lock()
+
+	if len(srv) != 0 {
+		f.known[name] = struct{}{}
+	} else if !known {
+		f.unknown[name] = struct{}{}
+	}
+
+	f.mutex.Unlock()
+	return
+}
+
+// The unknownCatalog type holds the list of registered services, it is kept
+// separate from the filter so the goroutine reloading it doesn't reference the
+// filter object.
+type unknownCatalog struct {
+	mutex sync.RWMutex
+	names map[string]struct{} // nil until the catalog was loaded
+}
+
+// contains returns true if name is in the catalog, or if the catalog was not
+// loaded, in which case the filter lets all names through.
+func (c *unknownCatalog) contains(name string) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.names == nil {
+		return true
+	}
+
+	_, ok := c.names[name]
+	return ok
+}
+
+func (c *unknownCatalog) load(catalog serviceCatalog) error {
+	list, err := catalog.services()
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]struct{}, len(list))
+	for _, name := range list {
+		names[name] = struct{}{}
+	}
+
+	c.mutex.Lock()
+	c.names = names
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *unknownCatalog) run(catalog serviceCatalog, refresh time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		// Errors are not fatal, the last catalog that was loaded keeps being
+		// used until the next reload succeeds.
+		if err := c.load(catalog); err != nil {
+			log.WithError(err).Warn("failed to load the catalog of services")
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type serviceNames []string
+
+func (s serviceNames) services() ([]string, error) {
+	return s, nil
+}
+
+func TestUnknownFilterLimit(t *testing.T) {
+	services := serviceMap{
+		"host-1": []service{{"host-1", 1000, nil}},
+	}
+
+	queries := 0
+	filter := filterUnknown(unknownFilterConfig{
+		limit:    2,
+		interval: time.Minute,
+	}, resolverFunc(func(name string) ([]service, error) {
+		queries++
+		return services.resolve(name)
+	}))
+
+	filter.resolve("host-1")
+
+	for i := 0; i != 10; i++ {
+		filter.resolve("unknown-" + strconv.Itoa(i))
+	}
+
+	if queries != 3 {
+		t.Error("the number of unknown names queried wasn't limited:", queries)
+	}
+
+	tests := []struct {
+		name string
+		srv  []service
+		err  error
+	}{
+		{"host-1", services["host-1"], nil},
+		{"unknown-0", []service{}, nil},
+		{"unknown-5", nil, errUnknownLimit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, err := filter.resolve(test.name)
+
+			if err != test.err {
+				t.Errorf("bad error: %v != %v", err, test.err)
+			}
+
+			if !reflect.DeepEqual(srv, test.srv) {
+				t.Errorf("%#v != %#v", srv, test.srv)
+			}
+		})
+	}
+}
+
+func TestUnknownFilterCatalog(t *testing.T) {
+	services := serviceMap{
+		"host-1": []service{{"host-1", 1000, nil}},
+	}
+
+	filter := filterUnknown(unknownFilterConfig{
+		catalog: serviceNames{"host-1"},
+		refresh: time.Minute,
+	}, services)
+
+	// Wait for the catalog to be loaded by the background goroutine.
+	for i := 0; i != 100 && filter.catalog.contains("host-2"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := filter.resolve("host-1"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := filter.resolve("host-2"); err != errUnknownService {
+		t.Error("a name missing from the catalog wasn't rejected:", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsEnv is the environment variable through which a process passes its
+// listening sockets to the process that replaces it. The value is a comma
+// separated list of name:fd pairs, names being the configuration option that
+// the listener was bound for (bind-http, bind-health-check, ...).
+const listenFDsEnv = "CONSUL_ROUTER_LISTEN_FDS"
+
+// readyFDEnv is the environment variable carrying the file descriptor of the
+// pipe on which the new process reports that it's serving, the process that
+// handed off its listeners keeps serving until then.
+const readyFDEnv = "CONSUL_ROUTER_READY_FD"
+
+// inheritedListeners returns the file descriptors passed to the program by the
+// process it replaces, indexed by listener name. The environment variable is
+// cleared so it doesn't leak to processes started later on.
+func inheritedListeners() (map[string]uintptr, error) {
+	fds := map[string]uintptr{}
+	env := os.Getenv(listenFDsEnv)
+	os.Unsetenv(listenFDsEnv)
+
+	if len(env) == 0 {
+		return fds, nil
+	}
+
+	for _, pair := range strings.Split(env, ",") {
+		i := strings.IndexByte(pair, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed inherited listener: %q", pair)
+		}
+
+		fd, err := strconv.ParseUint(pair[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed inherited listener: %q", pair)
+		}
+
+		fds[pair[:i]] = uintptr(fd)
+	}
+
+	return fds, nil
+}
+
+// listen returns a listener for the given name, reusing the socket inherited
+// from the parent process if there's one. The address may also be set to
+// fd://<n> to use a socket that was opened by whoever started the program.
+func listen(name string, address string, inherited map[string]uintptr) (net.Listener, error) {
+	if fd, ok := inherited[name]; ok {
+		return fileListener(fd, name)
+	}
+
+	if strings.HasPrefix(address, "fd://") {
+		fd, err := strconv.ParseUint(address[5:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed file descriptor address: %q", address)
+		}
+		return fileListener(uintptr(fd), name)
+	}
+
+	return net.Listen("tcp", address)
+}
+
+func fileListener(fd uintptr, name string) (net.Listener, error) {
+	f := os.NewFile(fd, name)
+	defer f.Close() // net.FileListener works on a copy of the descriptor
+	return net.FileListener(f)
+}
+
+// notifyReady tells the process that handed off its listeners that the program
+// is now serving, it does nothing if the program wasn't started by handoff.
+func notifyReady() error {
+	env := os.Getenv(readyFDEnv)
+	os.Unsetenv(readyFDEnv)
+
+	if len(env) == 0 {
+		return nil
+	}
+
+	fd, err := strconv.ParseUint(env, 10, 32)
+	if err != nil {
+		return fmt.Errorf("malformed ready file descriptor: %q", env)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+
+	_, err = f.Write([]byte{'\n'})
+	return err
+}
+
+// handoff starts a new instance of the program with the same arguments,
+// passing it the listening sockets so it can start accepting connections while
+// the current process drains the ones it has already accepted.
+//
+// The function returns once the new process reported that it's serving. If it
+// exits or doesn't report it within the timeout it is killed and an error is
+// returned, the current process must then keep serving.
+func handoff(listeners map[string]net.Listener, timeout time.Duration) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	pairs := make([]string, 0, len(names))
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, name := range names {
+		l, ok := listeners[name].(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("the %s listener cannot be passed to another process", name)
+		}
+
+		f, err := l.File()
+		if err != nil {
+			return nil, err
+		}
+
+		// The first three file descriptors of the child are stdin, stdout
+		// and stderr, extra files are numbered from 3.
+		pairs = append(pairs, name+":"+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no listeners to pass to the new process")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		listenFDsEnv+"="+strings.Join(pairs, ","),
+		readyFDEnv+"="+strconv.Itoa(3+len(files)),
+	)
+
+	err = cmd.Start()
+	// Only the child must hold the write end, reading from the pipe returns
+	// io.EOF if it exits without reporting that it's serving.
+	w.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = waitReady(r, timeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
+
+// waitReady waits for the new process to write to the ready pipe.
+func waitReady(r *os.File, timeout time.Duration) error {
+	if timeout != 0 {
+		r.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		if err == io.EOF {
+			err = errors.New("the new process exited before serving")
+		}
+		return fmt.Errorf("the new process didn't report that it's serving: %w", err)
+	}
+
+	return nil
+}
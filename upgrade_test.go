@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	tests := []struct {
+		env string
+		fds map[string]uintptr
+		err bool
+	}{
+		{"", map[string]uintptr{}, false},
+		{"bind-http:3", map[string]uintptr{"bind-http": 3}, false},
+		{"bind-health-check:4,bind-http:3", map[string]uintptr{"bind-http": 3, "bind-health-check": 4}, false},
+		{"bind-http", nil, true},
+		{"bind-http:fd", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.env, func(t *testing.T) {
+			os.Setenv(listenFDsEnv, test.env)
+			fds, err := inheritedListeners()
+
+			if (err != nil) != test.err {
+				t.Error("unexpected error:", err)
+			}
+
+			if !reflect.DeepEqual(fds, test.fds) {
+				t.Errorf("bad file descriptors: %v != %v", fds, test.fds)
+			}
+
+			if _, ok := os.LookupEnv(listenFDsEnv); ok {
+				t.Error("the environment variable wasn't cleared")
+			}
+		})
+	}
+}
+
+func TestListenInherited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Each test gets a copy of the file descriptor since listen takes
+	// ownership of it.
+	dup := func() uintptr {
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uintptr(fd)
+	}
+
+	tests := []struct {
+		name   string
+		listen func() (net.Listener, error)
+	}{
+		{"inherited", func() (net.Listener, error) {
+			return listen("bind-http", "127.0.0.1:0", map[string]uintptr{"bind-http": dup()})
+		}},
+		{"address", func() (net.Listener, error) {
+			return listen("bind-http", "fd://"+strconv.Itoa(int(dup())), nil)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lstn, err := test.listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lstn.Close()
+
+			if lstn.Addr().String() != l.Addr().String() {
+				t.Errorf("the listener isn't bound to the inherited socket: %s != %s", lstn.Addr(), l.Addr())
+			}
+		})
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(readyFDEnv, strconv.Itoa(fd))
+
+	if err := notifyReady(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(os.Getenv(readyFDEnv)) != 0 {
+		t.Error("the environment variable wasn't cleared")
+	}
+
+	if err := waitReady(r, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		r, w, _ := os.Pipe()
+		defer r.Close()
+		defer w.Close()
+
+		if err := waitReady(r, 10*time.Millisecond); err == nil {
+			t.Error("waiting for a process that never reports should fail")
+		}
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		r, w, _ := os.Pipe()
+		defer r.Close()
+		w.Close()
+
+		if err := waitReady(r, time.Second); err == nil {
+			t.Error("waiting for a process that exited should fail")
+		}
+	})
+}